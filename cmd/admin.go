@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hacox/pkg/hacox"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// adminOptions are the options of the subcommands that talk to the admin API
+// of a running hacox.
+type adminOptions struct {
+	addr   string
+	output string
+}
+
+func (o *adminOptions) addFlags(cmd *cobra.Command, output bool) {
+	cmd.Flags().StringVar(&o.addr, "admin-addr", hacox.DefaultAdminAddr, "the admin API address of the running hacox")
+	if output {
+		cmd.Flags().StringVarP(&o.output, "output", "o", outputTable, "the output format, one of table and json")
+	}
+}
+
+func (o *adminOptions) client() (*hacox.AdminClient, error) {
+	if o.output != "" && o.output != outputTable && o.output != outputJSON {
+		return nil, fmt.Errorf("invalid output format %q", o.output)
+	}
+	return hacox.NewAdminClient(o.addr), nil
+}
+
+func NewAdminCommands() []*cobra.Command {
+	return []*cobra.Command{
+		newStatusCommand(),
+		newBackendsCommand(),
+		newConnectionsCommand(),
+		newSetBackendCommand("drain", "stop sending new connections to a backend, its connections are kept", (*hacox.AdminClient).Drain),
+		newSetBackendCommand("undrain", "use a draining or disabled backend again", (*hacox.AdminClient).Enable),
+		newSetBackendCommand("disable", "stop using a backend and close its connections", (*hacox.AdminClient).Disable),
+		newRefreshCommand(),
+	}
+}
+
+func newStatusCommand() *cobra.Command {
+	var o adminOptions
+	cmd := &cobra.Command{
+		Use:          "status",
+		Short:        "show the status of the running hacox",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			status, err := c.Status(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if o.output == outputJSON {
+				return printJSON(os.Stdout, status)
+			}
+
+			lastCheck := "never"
+			if !status.LastCheck.IsZero() {
+				lastCheck = fmt.Sprintf("%s ago", time.Since(status.LastCheck).Round(time.Second))
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintf(w, "Serving:\t%t\n", status.Serving)
+			fmt.Fprintf(w, "Last check:\t%s\n", lastCheck)
+			fmt.Fprintf(w, "Backends:\t%d\n", status.Backends)
+			fmt.Fprintf(w, "Healthy:\t%d\n", status.Healthy)
+			fmt.Fprintf(w, "Available:\t%d\n", status.Available)
+			fmt.Fprintf(w, "Standby:\t%d\n", status.Standby)
+			fmt.Fprintf(w, "Draining:\t%d\n", status.Draining)
+			fmt.Fprintf(w, "Disabled:\t%d\n", status.Disabled)
+			fmt.Fprintf(w, "Connections:\t%d\n", status.Connections)
+			return w.Flush()
+		},
+	}
+	o.addFlags(cmd, true)
+	return cmd
+}
+
+func newBackendsCommand() *cobra.Command {
+	var o adminOptions
+	cmd := &cobra.Command{
+		Use:          "backends",
+		Short:        "list the backends of the running hacox",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			backends, err := c.Backends(cmd.Context())
+			if err != nil {
+				return err
+			}
+			if o.output == outputJSON {
+				return printJSON(os.Stdout, backends)
+			}
+			return printBackends(os.Stdout, backends...)
+		},
+	}
+	o.addFlags(cmd, true)
+	return cmd
+}
+
+func newConnectionsCommand() *cobra.Command {
+	var (
+		o       adminOptions
+		backend string
+	)
+	cmd := &cobra.Command{
+		Use:          "connections",
+		Short:        "list the client connections of the running hacox and their local processes",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			conns, err := c.Connections(cmd.Context(), backend)
+			if err != nil {
+				return err
+			}
+			if o.output == outputJSON {
+				return printJSON(os.Stdout, conns)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "CLIENT\tBACKEND\tAGE\tIN\tOUT\tPID\tCOMMAND\tPOD")
+			for _, conn := range conns {
+				pid, command, pod := "<unknown>", "<unknown>", "<none>"
+				if p := conn.Process; p != nil {
+					pid, command = fmt.Sprint(p.PID), p.Command
+					if p.PodUID != "" {
+						pod = p.PodUID
+					}
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", conn.Client, conn.Backend, time.Since(conn.Started).Round(time.Second), formatBytes(conn.BytesIn), formatBytes(conn.BytesOut), pid, command, pod)
+			}
+			return w.Flush()
+		},
+	}
+	o.addFlags(cmd, true)
+	cmd.Flags().StringVar(&backend, "backend", "", "only list the connections of this backend")
+	return cmd
+}
+
+func newSetBackendCommand(use, short string, f func(c *hacox.AdminClient, ctx context.Context, address string) (hacox.BackendStatus, error)) *cobra.Command {
+	var o adminOptions
+	cmd := &cobra.Command{
+		Use:          use + " <backend>",
+		Short:        short,
+		Example:      fmt.Sprintf("  hacox %s 10.0.0.1:6443", use),
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			backend, err := f(c, cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			if o.output == outputJSON {
+				return printJSON(os.Stdout, backend)
+			}
+			return printBackends(os.Stdout, backend)
+		},
+	}
+	o.addFlags(cmd, true)
+	return cmd
+}
+
+func newRefreshCommand() *cobra.Command {
+	var (
+		o     adminOptions
+		probe bool
+	)
+	cmd := &cobra.Command{
+		Use:          "refresh",
+		Short:        "discover the backends of the running hacox now",
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, err := o.client()
+			if err != nil {
+				return err
+			}
+			if err := c.Refresh(cmd.Context()); err != nil {
+				return err
+			}
+			fmt.Println("refresh requested")
+			if probe {
+				if err := c.Probe(cmd.Context()); err != nil {
+					return err
+				}
+				fmt.Println("health check requested")
+			}
+			return nil
+		},
+	}
+	o.addFlags(cmd, false)
+	cmd.Flags().BoolVar(&probe, "probe", false, "also check the health of the backends now")
+	return cmd
+}
+
+func printJSON(w io.Writer, v any) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+func printBackends(out io.Writer, backends ...hacox.BackendStatus) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tGROUP\tSOURCE\tWEIGHT\tHEALTHY\tSTATE\tCONNECTIONS")
+	for _, b := range backends {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\t%s\t%d\n", b.Address, orNone(b.Group), orNone(b.Source), b.Weight, b.Healthy, backendState(b.Backend), b.Connections)
+	}
+	return w.Flush()
+}
+
+func backendState(b hacox.Backend) string {
+	var states []string
+	if b.Standby {
+		states = append(states, "standby")
+	}
+	if b.Stale {
+		states = append(states, "stale")
+	}
+	if b.Draining {
+		states = append(states, "draining")
+	}
+	if b.Disabled {
+		states = append(states, "disabled")
+	}
+	if len(states) == 0 {
+		return "active"
+	}
+	return strings.Join(states, ",")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
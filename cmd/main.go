@@ -1,27 +1,24 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"hacox/pkg/hacox"
 	"hacox/version"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"time"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-}
-
 func main() {
-	flags := pflag.NewFlagSet("config", pflag.ExitOnError)
-	pflag.CommandLine = flags
-
-	root := NewRootCommand(flags)
+	root := NewRootCommand(pflag.NewFlagSet("config", pflag.ExitOnError))
+	root.AddCommand(NewAdminCommands()...)
 	if err := root.Execute(); err != nil {
 		os.Exit(1)
 	}
@@ -29,52 +26,136 @@ func main() {
 
 func NewRootCommand(flags *pflag.FlagSet) *cobra.Command {
 	var (
-		kubeConfig              string
-		serversConfig           string
-		listenAddrs             []string
-		backendPort             int
-		unHealthyCountThreshold int
-		checkInterval           time.Duration
-		refreshInterval         time.Duration
-		showVersion             bool
-		metricsAddr             string
+		opts         = hacox.DefaultOptions()
+		showVersion  bool
+		addressTypes []string
+		allowCIDRs   []string
+		denyCIDRs    []string
+		ipFamily     string
+		logFormat    string
+		logLevel     string
 	)
 
+	// the kubelet names the node after the hostname by default
+	hostname, _ := os.Hostname()
+	opts.NodeName = strings.ToLower(hostname)
+
 	defaultKubeConfig := filepath.Join(".kube", "config")
 	homeDir, _ := os.UserHomeDir()
 	if homeDir != "" {
 		defaultKubeConfig = filepath.Join(homeDir, defaultKubeConfig)
 	}
 
-	flags.StringSliceVar(&listenAddrs, "address", []string{"127.0.0.1:5443", "[::1]:5443"}, "the listen addresses")
-	flags.IntVar(&backendPort, "backend-port", 6443, "the backend apiserver listening port")
-	flags.DurationVar(&checkInterval, "check-interval", 2*time.Second, "the interval for checking the health of the backend apiservers")
-	flags.StringVar(&kubeConfig, "kubeconfig", defaultKubeConfig, "the Kubernetes client config path")
-	flags.StringVar(&metricsAddr, "metrics-addr", ":5444", "the metrics listen address")
-	flags.IntVar(&unHealthyCountThreshold, "unhealthy-count-threshold", 3, "the threshold for the number of unhealthy counts")
-	flags.DurationVar(&refreshInterval, "refresh-interval", 2*time.Minute, "the interval for refresh the backend apiserver addresses config from the Kubernetes cluster")
-	flags.StringVar(&serversConfig, "servers-config", "servers.yaml", "the backend apiserver addresses config path")
+	flags.StringVar(&opts.AccessLog, "access-log", opts.AccessLog, "the file the connections are written to as lines of JSON, - for stdout, empty to disable")
+	flags.IntVar(&opts.AccessLogMaxBackups, "access-log-max-backups", opts.AccessLogMaxBackups, "the number of rotated access log files to keep")
+	flags.IntVar(&opts.AccessLogMaxSize, "access-log-max-size", opts.AccessLogMaxSize, "the size in megabytes at which the access log file is rotated")
+	flags.Float64Var(&opts.AccessLogSampleRate, "access-log-sample-rate", opts.AccessLogSampleRate, "the fraction of the connections written to the access log, the connections that fail before reaching a backend are always written")
+	flags.StringSliceVar(&opts.ListenAddrs, "address", opts.ListenAddrs, "the listen addresses")
+	flags.StringSliceVar(&addressTypes, "address-types", hacox.DefaultAddressTypes, "the address types of the discovered apiservers, any of InternalIP, ExternalIP, PodIP and HostIP")
+	flags.StringVar(&opts.AdminAddr, "admin-addr", opts.AdminAddr, "the admin API listen address, such as 127.0.0.1:5445, which has no authentication and should be kept on localhost, empty to disable")
+	flags.StringSliceVar(&allowCIDRs, "allow-cidrs", nil, "only discover apiserver addresses in these CIDRs")
+	flags.IntVar(&opts.BackendPort, "backend-port", opts.BackendPort, "the backend apiserver listening port")
+	flags.BoolVar(&opts.BindWhenReady, "bind-when-ready", opts.BindWhenReady, "listen on the listen addresses only once the health check has found an available backend")
+	flags.DurationVar(&opts.CheckInterval, "check-interval", opts.CheckInterval, "the interval for checking the health of the backend apiservers")
+	flags.IntVar(&opts.Safeguards.ConsensusServers, "consensus-servers", opts.Safeguards.ConsensusServers, "the number of servers a discovery queries, keeping only the addresses reported by a majority of them, 0 to use the first server that answers")
+	flags.StringSliceVar(&denyCIDRs, "deny-cidrs", nil, "never discover apiserver addresses in these CIDRs")
+	flags.BoolVar(&opts.Safeguards.DryRun, "discovery-dry-run", opts.Safeguards.DryRun, "log the changes of the discovered servers without applying them")
+	flags.BoolVar(&opts.Events, "events", opts.Events, "post Kubernetes Events about the node when the backends change, with the kubeconfig credentials")
+	flags.StringVar(&opts.HandoffSocket, "handoff-socket", opts.HandoffSocket, "the unix socket for handing the listeners over to a new hacox process, which takes them over on start, empty to disable")
+	flags.StringVar(&ipFamily, "ip-family", hacox.IPFamilyAny, "the preferred ip family of the discovered apiserver addresses, one of any, ipv4 and ipv6, the other family is only kept for the nodes without an address in it")
+	flags.StringSliceVar(&opts.KubeConfigPaths, "kubeconfig", []string{defaultKubeConfig}, "the Kubernetes client config paths, the first one that exists and has valid credentials is used")
+	flags.DurationVar(&opts.LeaseCheckInterval, "lease-check-interval", opts.LeaseCheckInterval, "the interval for checking the kube-apiserver identity leases, 0 to disable")
+	flags.DurationVar(&opts.LeaseStaleThreshold, "lease-stale-threshold", opts.LeaseStaleThreshold, "the duration after which a kube-apiserver identity lease that is not renewed is considered stale")
+	flags.DurationVar(&opts.LivenessTimeout, "liveness-timeout", opts.LivenessTimeout, "the duration after which a proxy, health check or discovery loop that has not made progress fails /healthz")
+	flags.StringVar(&logFormat, "log-format", "text", "the log format, one of text and json")
+	flags.StringVar(&logLevel, "log-level", "info", "the log level, one of debug, info, warn and error")
+	flags.Float64Var(&opts.Safeguards.MaxRemoveFraction, "max-remove-fraction", opts.Safeguards.MaxRemoveFraction, "the maximum fraction of the servers removed by a discovery, 0 for no limit")
+	flags.StringVar(&opts.MetricsAddr, "metrics-addr", opts.MetricsAddr, "the listen address of the metrics, /healthz and /readyz")
+	flags.IntVar(&opts.Safeguards.MinServers, "min-servers", opts.Safeguards.MinServers, "the minimum number of discovered apiservers to accept a discovery, counting the addresses of a node once")
+	flags.BoolVar(&opts.NodeCondition, "node-condition", opts.NodeCondition, "report the health of the backends as the HacoxDegraded condition of the node, with the kubeconfig credentials")
+	flags.StringVar(&opts.NodeName, "node-name", opts.NodeName, "the name of the node hacox runs on")
+	flags.BoolVar(&opts.ProcessMetrics, "process-metrics", opts.ProcessMetrics, "export hacox_client_connections, the number of client connections of each local process, which walks every process on each scrape")
+	flags.IntVar(&opts.UnHealthyCountThreshold, "unhealthy-count-threshold", opts.UnHealthyCountThreshold, "the threshold for the number of unhealthy counts")
+	flags.DurationVar(&opts.RefreshInterval, "refresh-interval", opts.RefreshInterval, "the interval for refresh the backend apiserver addresses config from the Kubernetes cluster")
+	flags.IntVar(&opts.Safeguards.RemoveConfirmations, "remove-confirmations", opts.Safeguards.RemoveConfirmations, "the number of consecutive discoveries a server must be missing from before it is removed")
+	flags.StringSliceVar(&opts.Seeds.Servers, "seed-servers", nil, "the apiservers to bootstrap from when the servers config is missing or empty and the kubeconfig server is not usable, in host or host:port")
+	flags.StringVar(&opts.Seeds.DNSName, "seed-dns-name", "", "the DNS name resolved to the apiservers to bootstrap from when no other seed is available")
+	flags.StringVar(&opts.ServersConfigPath, "servers-config", opts.ServersConfigPath, "the backend apiserver addresses config path")
+	flags.DurationVar(&opts.StandbyCheckInterval, "standby-check-interval", opts.StandbyCheckInterval, "the interval for checking the health of the standby apiservers")
+	flags.DurationVar(&opts.StandbyTTL, "standby-ttl", opts.StandbyTTL, "the duration for keeping a removed apiserver as standby, which is only used when no other apiserver is available, 0 to disable")
+	flags.DurationVar(&opts.ShutdownGracePeriod, "shutdown-grace-period", opts.ShutdownGracePeriod, "the duration for the connections to finish after receiving SIGTERM or SIGINT, before they are closed")
+	flags.BoolVar(&opts.Filter.SkipNotReadyNodes, "skip-not-ready-nodes", opts.Filter.SkipNotReadyNodes, "skip control-plane nodes that are not ready during discovery")
+	flags.BoolVar(&opts.Filter.SkipCordonedNodes, "skip-cordoned-nodes", opts.Filter.SkipCordonedNodes, "skip cordoned control-plane nodes during discovery")
+	flags.BoolVar(&opts.Filter.SkipTerminatingNodes, "skip-terminating-nodes", opts.Filter.SkipTerminatingNodes, "skip control-plane nodes that are being deleted during discovery")
+	flags.BoolVar(&opts.Filter.SkipTerminatingPods, "skip-terminating-pods", opts.Filter.SkipTerminatingPods, "skip apiserver pods that are terminating during discovery")
+	flags.BoolVar(&opts.Filter.SkipNotRunningPods, "skip-not-running-pods", opts.Filter.SkipNotRunningPods, "skip apiserver pods that are not running during discovery")
+	flags.BoolVar(&opts.Filter.SkipNotReadyPods, "skip-not-ready-pods", opts.Filter.SkipNotReadyPods, "skip apiserver pods that are not ready during discovery")
 	flags.BoolVar(&showVersion, "version", false, "show version")
 
 	cmd := &cobra.Command{
+		Use:   "hacox",
 		Short: "proxy multiple Kubernetes apiservers",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if showVersion {
 				fmt.Println(version.BuildVersion)
 				return nil
 			}
-			return hacox.Start(
-				kubeConfig,
-				serversConfig,
-				metricsAddr,
-				listenAddrs,
-				backendPort,
-				unHealthyCountThreshold,
-				checkInterval,
-				refreshInterval,
-			)
+			logger, err := newLogger(logFormat, logLevel)
+			if err != nil {
+				return err
+			}
+			slog.SetDefault(logger)
+			opts.Logger = logger
+
+			policy, err := hacox.NewAddressPolicy(addressTypes, allowCIDRs, denyCIDRs, ipFamily)
+			if err != nil {
+				return err
+			}
+			opts.AddressPolicy = policy
+
+			// listeners passed by systemd socket activation are served besides --address
+			if opts.Listeners, err = hacox.SystemdListeners(); err != nil {
+				return err
+			}
+			opts.SystemdNotify = os.Getenv("NOTIFY_SOCKET") != ""
+
+			h, err := hacox.New(opts)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				// a second signal terminates immediately
+				stop()
+			}()
+			return h.Run(ctx)
 		},
 	}
+	cmd.CompletionOptions.DisableDefaultCmd = true
+	// the flags of the proxy are not inherited by the subcommands
+	cmd.Flags().AddFlagSet(flags)
 
 	return cmd
 }
+
+// newLogger creates a logger writing records of at least level to stderr in
+// format.
+func newLogger(format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+}
@@ -0,0 +1,178 @@
+package hacox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// the reasons of closing a connection in the access log
+const (
+	reasonClientClosed     = "client closed"
+	reasonBackendClosed    = "backend closed"
+	reasonBackendRemoved   = "backend removed"
+	reasonBackendUnhealthy = "backend unhealthy"
+	reasonBackendDisabled  = "backend disabled"
+	reasonShutdown         = "shutdown"
+	reasonNoBackend        = "no backend available"
+)
+
+// AccessLogEntry is a connection in the access log, written as a line of
+// JSON when the connection is closed.
+type AccessLogEntry struct {
+	Client string `json:"client"`
+	// Local is the listen address the client connected to.
+	Local string `json:"local"`
+	// Upstream is the local address of the connection to the backend, which
+	// is the client address in the audit log of the apiserver.
+	Upstream string    `json:"upstream,omitempty"`
+	Backend  string    `json:"backend,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	// BytesIn are received from the client and BytesOut are sent to it.
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+	Reason   string `json:"reason"`
+}
+
+// AccessLog writes the entries of a sample of the connections. The
+// connections that fail before reaching a backend are always written.
+type AccessLog struct {
+	lock       sync.Mutex
+	w          io.Writer
+	sampleRate float64
+	log        *slog.Logger
+}
+
+// NewAccessLog creates an access log writing to w the entries of sampleRate,
+// between 0 and 1, of the connections. The write errors are logged with
+// logger, nil for the default logger of slog.
+func NewAccessLog(w io.Writer, sampleRate float64, logger *slog.Logger) *AccessLog {
+	return &AccessLog{
+		w:          w,
+		sampleRate: sampleRate,
+		log:        componentLogger(logger, "proxy"),
+	}
+}
+
+func (l *AccessLog) sample() bool {
+	return l.sampleRate >= 1 || rand.Float64() < l.sampleRate
+}
+
+func (l *AccessLog) Log(entry AccessLogEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, err := l.w.Write(b); err != nil {
+		l.log.Error("write access log error", "error", err)
+	}
+}
+
+// OpenAccessLog opens the access log file at path, or stdout if path is "-".
+// The file is rotated when it would exceed maxSize bytes, keeping maxBackups
+// rotated files as path.1, path.2 and so on.
+func OpenAccessLog(path string, maxSize int64, maxBackups int) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// rotatingFile is a file that is rotated by size. It is not safe for
+// concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write writes b to the file, rotating it first if b would exceed the
+// maximum size. If the rotation fails, b is written to the current file and
+// the rotation is retried on the next write.
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	var rotateErr error
+	if f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			rotateErr = fmt.Errorf("rotate %s error: %v", f.path, err)
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate moves the file aside before closing it, so that the file stays
+// open if the rotation fails.
+func (f *rotatingFile) rotate() error {
+	if f.maxBackups > 0 {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
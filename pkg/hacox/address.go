@@ -0,0 +1,238 @@
+package hacox
+
+import (
+	"fmt"
+	"log/slog"
+	stdnet "net"
+	"slices"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/net"
+)
+
+const (
+	AddressTypeInternalIP = string(corev1.NodeInternalIP)
+	AddressTypeExternalIP = string(corev1.NodeExternalIP)
+	AddressTypePodIP      = "PodIP"
+	AddressTypeHostIP     = "HostIP"
+
+	IPFamilyAny  = "any"
+	IPFamilyIPv4 = "ipv4"
+	IPFamilyIPv6 = "ipv6"
+)
+
+var (
+	addressTypes = []string{
+		AddressTypeInternalIP,
+		AddressTypeExternalIP,
+		AddressTypePodIP,
+		AddressTypeHostIP,
+	}
+	DefaultAddressTypes = []string{
+		AddressTypeInternalIP,
+		AddressTypePodIP,
+		AddressTypeHostIP,
+	}
+)
+
+type AddressPolicy struct {
+	types    []string
+	allow    []*stdnet.IPNet
+	deny     []*stdnet.IPNet
+	ipFamily string
+}
+
+func NewAddressPolicy(types, allowCIDRs, denyCIDRs []string, ipFamily string) (*AddressPolicy, error) {
+	p := &AddressPolicy{}
+
+	for _, it := range types {
+		idx := slices.IndexFunc(addressTypes, func(t string) bool { return strings.EqualFold(t, it) })
+		if idx == -1 {
+			return nil, fmt.Errorf("unknown address type %s, must be one of %s", it, strings.Join(addressTypes, ", "))
+		}
+		p.types = append(p.types, addressTypes[idx])
+	}
+
+	for _, it := range allowCIDRs {
+		_, cidr, err := stdnet.ParseCIDR(it)
+		if err != nil {
+			return nil, fmt.Errorf("parse allowed cidr %s error: %v", it, err)
+		}
+		p.allow = append(p.allow, cidr)
+	}
+
+	for _, it := range denyCIDRs {
+		_, cidr, err := stdnet.ParseCIDR(it)
+		if err != nil {
+			return nil, fmt.Errorf("parse denied cidr %s error: %v", it, err)
+		}
+		p.deny = append(p.deny, cidr)
+	}
+
+	switch strings.ToLower(ipFamily) {
+	case "", IPFamilyAny:
+		p.ipFamily = IPFamilyAny
+	case IPFamilyIPv4, IPFamilyIPv6:
+		p.ipFamily = strings.ToLower(ipFamily)
+	default:
+		return nil, fmt.Errorf("unknown ip family %s, must be one of %s, %s, %s", ipFamily, IPFamilyAny, IPFamilyIPv4, IPFamilyIPv6)
+	}
+
+	return p, nil
+}
+
+// skipReason returns why the address of the given type should be excluded
+// from discovery, or an empty string if it should be kept.
+func (p *AddressPolicy) skipReason(addressType, address string) string {
+	ip := net.ParseIPSloppy(address)
+	if ip == nil {
+		return "invalid ip"
+	}
+
+	if p == nil {
+		p = &AddressPolicy{}
+	}
+
+	types := p.types
+	if len(types) == 0 {
+		types = DefaultAddressTypes
+	}
+	if !slices.Contains(types, addressType) {
+		return "address type " + addressType + " is not selected"
+	}
+
+	for _, cidr := range p.deny {
+		if cidr.Contains(ip) {
+			return "denied by " + cidr.String()
+		}
+	}
+
+	if len(p.allow) > 0 && !slices.ContainsFunc(p.allow, func(cidr *stdnet.IPNet) bool { return cidr.Contains(ip) }) {
+		return "not in the allowed cidrs"
+	}
+
+	return ""
+}
+
+// inFamily reports whether the address is in the preferred ip family.
+func (p *AddressPolicy) inFamily(address string) bool {
+	ip := net.ParseIPSloppy(address)
+	switch {
+	case p == nil || p.ipFamily == IPFamilyAny:
+		return true
+	case p.ipFamily == IPFamilyIPv4:
+		return net.IsIPv4(ip)
+	default:
+		return net.IsIPv6(ip)
+	}
+}
+
+// preferFamily drops the addresses of a node outside the preferred ip family
+// if the node has an address in it, so that a node with addresses of the
+// other family only is kept.
+func (p *AddressPolicy) preferFamily(hosts *clusterHosts, log *slog.Logger) {
+	for node, addresses := range hosts.nodes {
+		if node == "" || !slices.ContainsFunc(addresses, p.inFamily) {
+			continue
+		}
+		var kept []string
+		for _, address := range addresses {
+			if p.inFamily(address) {
+				kept = append(kept, address)
+				continue
+			}
+			log.Debug("skip address", "address", address, "node", node, "reason", "not in the preferred ip family "+p.ipFamily)
+			delete(hosts.sources, address)
+		}
+		hosts.nodes[node] = kept
+	}
+}
+
+// clusterHosts holds the discovered apiserver addresses grouped by the node
+// they belong to, so that an apiserver with several addresses counts once.
+type clusterHosts struct {
+	nodes   map[string][]string
+	aliases map[string]string
+	zones   map[string]string
+	sources map[string]string
+	// skipped are the reasons of the nodes and pods skipped by the filter,
+	// the apiserver pods on the skipped nodes are skipped too.
+	skipped map[skippedMember]string
+}
+
+// skippedMember is a node or a pod skipped by the discovery filter.
+type skippedMember struct {
+	kind string
+	name string
+}
+
+func newClusterHosts() *clusterHosts {
+	return &clusterHosts{
+		nodes:   make(map[string][]string),
+		aliases: make(map[string]string),
+		zones:   make(map[string]string),
+		sources: make(map[string]string),
+		skipped: make(map[skippedMember]string),
+	}
+}
+
+func (h *clusterHosts) add(node, address, source string) {
+	if !slices.Contains(h.nodes[node], address) {
+		h.nodes[node] = append(h.nodes[node], address)
+	}
+	if _, ok := h.sources[address]; !ok {
+		h.sources[address] = source
+	}
+}
+
+func (h *clusterHosts) alias(hostname, node string) {
+	if hostname != node {
+		h.aliases[hostname] = node
+	}
+}
+
+// lookup returns the addresses of the node with the given name or hostname.
+func (h *clusterHosts) lookup(hostname string) []string {
+	if h == nil {
+		return nil
+	}
+	if node, ok := h.aliases[hostname]; ok {
+		hostname = node
+	}
+	return h.nodes[hostname]
+}
+
+// nodeOf returns the name of the node the address belongs to.
+func (h *clusterHosts) nodeOf(address string) string {
+	for node, addresses := range h.nodes {
+		if node != "" && slices.Contains(addresses, address) {
+			return node
+		}
+	}
+	return ""
+}
+
+// apiservers returns the number of apiservers found, counting the addresses
+// of a node once, like the groups of the entries.
+func (h *clusterHosts) apiservers() int {
+	groups := make(map[string]struct{})
+	for _, address := range h.servers() {
+		group := h.nodeOf(address)
+		if group == "" {
+			group = address
+		}
+		groups[group] = struct{}{}
+	}
+	return len(groups)
+}
+
+func (h *clusterHosts) servers() []string {
+	var r []string
+	for _, addresses := range h.nodes {
+		r = merge(r, addresses)
+	}
+	sort.Strings(r)
+	return r
+}
@@ -0,0 +1,101 @@
+package hacox
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNewAddressPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		types    []string
+		allow    []string
+		deny     []string
+		ipFamily string
+		wantErr  bool
+	}{
+		{name: "default"},
+		{name: "types case insensitive", types: []string{"internalip", "PodIP"}},
+		{name: "unknown type", types: []string{"Hostname"}, wantErr: true},
+		{name: "cidrs", allow: []string{"10.0.0.0/8"}, deny: []string{"fd00::/8"}},
+		{name: "invalid allowed cidr", allow: []string{"10.0.0.1"}, wantErr: true},
+		{name: "invalid denied cidr", deny: []string{"10.0.0.0/33"}, wantErr: true},
+		{name: "ip family", ipFamily: "IPv6"},
+		{name: "unknown ip family", ipFamily: "ipv5", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAddressPolicy(tt.types, tt.allow, tt.deny, tt.ipFamily)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAddressPolicySkipReason(t *testing.T) {
+	tests := []struct {
+		name        string
+		types       []string
+		allow       []string
+		deny        []string
+		addressType string
+		address     string
+		skip        bool
+	}{
+		{name: "default type", addressType: AddressTypeInternalIP, address: "10.0.0.1"},
+		{name: "not a default type", addressType: AddressTypeExternalIP, address: "1.2.3.4", skip: true},
+		{name: "selected type", types: []string{AddressTypeExternalIP}, addressType: AddressTypeExternalIP, address: "1.2.3.4"},
+		{name: "not a selected type", types: []string{AddressTypeExternalIP}, addressType: AddressTypeInternalIP, address: "10.0.0.1", skip: true},
+		{name: "invalid ip", addressType: AddressTypeInternalIP, address: "m1", skip: true},
+		{name: "allowed", allow: []string{"10.0.0.0/8"}, addressType: AddressTypePodIP, address: "10.1.2.3"},
+		{name: "not allowed", allow: []string{"10.0.0.0/8"}, addressType: AddressTypePodIP, address: "192.168.0.1", skip: true},
+		{name: "denied", deny: []string{"10.1.0.0/16"}, addressType: AddressTypePodIP, address: "10.1.2.3", skip: true},
+		{name: "denied over allowed", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, addressType: AddressTypePodIP, address: "10.1.2.3", skip: true},
+		{name: "ipv6 denied", deny: []string{"fd00::/8"}, addressType: AddressTypeHostIP, address: "fd00::1", skip: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewAddressPolicy(tt.types, tt.allow, tt.deny, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reason := p.skipReason(tt.addressType, tt.address); (reason != "") != tt.skip {
+				t.Errorf("skipReason(%s, %s) = %q, want skip %v", tt.addressType, tt.address, reason, tt.skip)
+			}
+		})
+	}
+}
+
+func TestAddressPolicyPreferFamily(t *testing.T) {
+	nodes := map[string][]string{
+		"dual": {"10.0.0.1", "fd00::1"},
+		"v4":   {"10.0.0.2"},
+		"v6":   {"fd00::3"},
+		"":     {"10.0.0.4", "fd00::4"},
+	}
+	tests := []struct {
+		ipFamily string
+		want     []string
+	}{
+		{IPFamilyAny, []string{"10.0.0.1", "10.0.0.2", "10.0.0.4", "fd00::1", "fd00::3", "fd00::4"}},
+		{IPFamilyIPv4, []string{"10.0.0.1", "10.0.0.2", "10.0.0.4", "fd00::3", "fd00::4"}},
+		{IPFamilyIPv6, []string{"10.0.0.2", "10.0.0.4", "fd00::1", "fd00::3", "fd00::4"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ipFamily, func(t *testing.T) {
+			p, err := NewAddressPolicy(nil, nil, nil, tt.ipFamily)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hosts := testHosts(nodes)
+			p.preferFamily(hosts, testLogger())
+			if got := hosts.servers(); !slices.Equal(got, tt.want) {
+				t.Errorf("servers = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package hacox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultAdminAddr is the usual listen address of the admin API, which is
+// disabled by default since it has no authentication.
+const DefaultAdminAddr = "127.0.0.1:5445"
+
+const adminEventsKeepAlive = 15 * time.Second
+
+// BackendStatus is the state of a backend returned by the admin API.
+type BackendStatus struct {
+	Backend
+	Connections int `json:"connections"`
+}
+
+// Status is the summary of hacox returned by the admin API.
+type Status struct {
+	// Serving reports whether the proxy is accepting connections.
+	Serving bool `json:"serving"`
+	// LastCheck is when the last round of health checks finished.
+	LastCheck   time.Time `json:"lastCheck"`
+	Backends    int       `json:"backends"`
+	Healthy     int       `json:"healthy"`
+	Available   int       `json:"available"`
+	Standby     int       `json:"standby"`
+	Draining    int       `json:"draining"`
+	Disabled    int       `json:"disabled"`
+	Connections int       `json:"connections"`
+}
+
+// Admin serves the admin API for inspecting and controlling the backends.
+type Admin struct {
+	serverListener
+	registry *Registry
+	proxy    *Proxy
+	hc       *HealthCheck
+	// refreshFunc requests a discovery, nil if the discovery can not be
+	// refreshed.
+	refreshFunc func()
+
+	lock    sync.Mutex
+	streams map[chan BackendEvent]struct{}
+	log     *slog.Logger
+}
+
+func NewAdmin(addr string, registry *Registry, proxy *Proxy, hc *HealthCheck, refreshFunc func(), logger *slog.Logger) *Admin {
+	a := &Admin{
+		serverListener: serverListener{addr: addr},
+		registry:       registry,
+		proxy:          proxy,
+		hc:             hc,
+		refreshFunc:    refreshFunc,
+		streams:        make(map[chan BackendEvent]struct{}),
+		log:            componentLogger(logger, "admin"),
+	}
+	registry.Subscribe(a.onEvent)
+	return a
+}
+
+// Handler returns the handler of the admin API:
+//
+//	GET  /api/v1/status                     the summary of hacox
+//	GET  /api/v1/backends                   the state of the backends
+//	GET  /api/v1/backends/{backend}         the state of a backend
+//	POST /api/v1/backends/{backend}/disable close the connections of a backend and stop using it
+//	POST /api/v1/backends/{backend}/drain   stop using a backend for new connections
+//	POST /api/v1/backends/{backend}/enable  use a disabled or draining backend again
+//	GET  /api/v1/connections                the client connections and their local processes
+//	POST /api/v1/refresh                    discover the backends now
+//	POST /api/v1/probe                      check the health of the backends now
+//	GET  /api/v1/events                     the changes of the backends as server-sent events
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/status", a.status)
+	mux.HandleFunc("GET /api/v1/backends", a.listBackends)
+	mux.HandleFunc("GET /api/v1/backends/{backend}", a.getBackend)
+	mux.HandleFunc("POST /api/v1/backends/{backend}/disable", a.setBackend("disable", func(backend string) bool {
+		return a.registry.SetDisabled(backend, true)
+	}))
+	mux.HandleFunc("POST /api/v1/backends/{backend}/drain", a.setBackend("drain", func(backend string) bool {
+		return a.registry.SetDraining(backend, true)
+	}))
+	mux.HandleFunc("POST /api/v1/backends/{backend}/enable", a.setBackend("enable", a.registry.Enable))
+	mux.HandleFunc("GET /api/v1/connections", a.connections)
+	mux.HandleFunc("POST /api/v1/refresh", a.refresh)
+	mux.HandleFunc("POST /api/v1/probe", a.probe)
+	mux.HandleFunc("GET /api/v1/events", a.events)
+	return mux
+}
+
+func (a *Admin) Start(ctx context.Context) error {
+	l, err := a.listen()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: a.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (a *Admin) status(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		Serving:   a.proxy.Serving(),
+		LastCheck: a.hc.LastCheck(),
+	}
+	for _, backend := range a.registry.List() {
+		status.Backends++
+		if backend.Healthy {
+			status.Healthy++
+		}
+		if backend.Available() {
+			status.Available++
+		}
+		if backend.Standby {
+			status.Standby++
+		}
+		if backend.Draining {
+			status.Draining++
+		}
+		if backend.Disabled {
+			status.Disabled++
+		}
+	}
+	for _, count := range a.proxy.GetBackendsClientsCount() {
+		status.Connections += count
+	}
+	a.writeJSON(w, http.StatusOK, status)
+}
+
+func (a *Admin) backendStatus(backend Backend, counts map[string]int) BackendStatus {
+	return BackendStatus{
+		Backend:     backend,
+		Connections: counts[backend.Address],
+	}
+}
+
+func (a *Admin) listBackends(w http.ResponseWriter, r *http.Request) {
+	counts := a.proxy.GetBackendsClientsCount()
+	backends := a.registry.List()
+
+	r2 := make([]BackendStatus, 0, len(backends))
+	for _, backend := range backends {
+		r2 = append(r2, a.backendStatus(backend, counts))
+	}
+	a.writeJSON(w, http.StatusOK, r2)
+}
+
+func (a *Admin) getBackend(w http.ResponseWriter, r *http.Request) {
+	backend, ok := a.registry.Get(r.PathValue("backend"))
+	if !ok {
+		a.writeError(w, http.StatusNotFound, fmt.Errorf("backend %s not found", r.PathValue("backend")))
+		return
+	}
+	a.writeJSON(w, http.StatusOK, a.backendStatus(backend, a.proxy.GetBackendsClientsCount()))
+}
+
+func (a *Admin) setBackend(action string, f func(backend string) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address := r.PathValue("backend")
+		if !f(address) {
+			a.writeError(w, http.StatusNotFound, fmt.Errorf("backend %s not found", address))
+			return
+		}
+		a.log.Info("set backend", "action", action, "backend", address, "remote", r.RemoteAddr)
+		a.getBackend(w, r)
+	}
+}
+
+// connections lists the client connections, of a backend with the backend
+// query parameter.
+func (a *Admin) connections(w http.ResponseWriter, r *http.Request) {
+	backend := r.URL.Query().Get("backend")
+	conns := make([]Connection, 0)
+	for _, conn := range a.proxy.Connections(true) {
+		if backend == "" || conn.Backend == backend {
+			conns = append(conns, conn)
+		}
+	}
+	a.writeJSON(w, http.StatusOK, conns)
+}
+
+func (a *Admin) refresh(w http.ResponseWriter, r *http.Request) {
+	if a.refreshFunc == nil {
+		a.writeError(w, http.StatusNotImplemented, fmt.Errorf("the discovery can not be refreshed"))
+		return
+	}
+	a.log.Info("refresh requested", "remote", r.RemoteAddr)
+	a.refreshFunc()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *Admin) probe(w http.ResponseWriter, r *http.Request) {
+	a.log.Info("health check requested", "remote", r.RemoteAddr)
+	a.hc.ProbeNow()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// events streams the changes of the backends until the client disconnects.
+// A client that does not keep up with the changes is disconnected.
+func (a *Admin) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		a.writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	stream := make(chan BackendEvent, 64)
+	a.lock.Lock()
+	a.streams[stream] = struct{}{}
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		delete(a.streams, stream)
+		a.lock.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(adminEventsKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-stream:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (a *Admin) onEvent(event BackendEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for stream := range a.streams {
+		select {
+		case stream <- event:
+		default:
+			close(stream)
+			delete(a.streams, stream)
+		}
+	}
+}
+
+func (a *Admin) writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.log.Warn("write response error", "error", err)
+	}
+}
+
+func (a *Admin) writeError(w http.ResponseWriter, code int, err error) {
+	a.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
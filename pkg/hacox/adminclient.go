@@ -0,0 +1,116 @@
+package hacox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// AdminClient is a client of the admin API of a running hacox.
+type AdminClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewAdminClient creates a client of the admin API listening on addr.
+func NewAdminClient(addr string) *AdminClient {
+	return &AdminClient{
+		baseURL: "http://" + addr,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *AdminClient) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := c.do(ctx, http.MethodGet, "/api/v1/status", &status)
+	return status, err
+}
+
+func (c *AdminClient) Backends(ctx context.Context) ([]BackendStatus, error) {
+	var backends []BackendStatus
+	err := c.do(ctx, http.MethodGet, "/api/v1/backends", &backends)
+	return backends, err
+}
+
+func (c *AdminClient) Backend(ctx context.Context, address string) (BackendStatus, error) {
+	var backend BackendStatus
+	err := c.do(ctx, http.MethodGet, "/api/v1/backends/"+url.PathEscape(address), &backend)
+	return backend, err
+}
+
+// Connections returns the client connections, of the backend if it is not
+// empty.
+func (c *AdminClient) Connections(ctx context.Context, backend string) ([]Connection, error) {
+	path := "/api/v1/connections"
+	if backend != "" {
+		path += "?" + url.Values{"backend": {backend}}.Encode()
+	}
+	var conns []Connection
+	err := c.do(ctx, http.MethodGet, path, &conns)
+	return conns, err
+}
+
+// Drain stops sending new connections to the backend.
+func (c *AdminClient) Drain(ctx context.Context, address string) (BackendStatus, error) {
+	return c.setBackend(ctx, address, "drain")
+}
+
+// Disable stops using the backend and closes its connections.
+func (c *AdminClient) Disable(ctx context.Context, address string) (BackendStatus, error) {
+	return c.setBackend(ctx, address, "disable")
+}
+
+// Enable uses a draining or disabled backend again.
+func (c *AdminClient) Enable(ctx context.Context, address string) (BackendStatus, error) {
+	return c.setBackend(ctx, address, "enable")
+}
+
+// Refresh requests a discovery of the backends.
+func (c *AdminClient) Refresh(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/refresh", nil)
+}
+
+// Probe requests a health check of the backends.
+func (c *AdminClient) Probe(ctx context.Context) error {
+	return c.do(ctx, http.MethodPost, "/api/v1/probe", nil)
+}
+
+func (c *AdminClient) setBackend(ctx context.Context, address, action string) (BackendStatus, error) {
+	var backend BackendStatus
+	err := c.do(ctx, http.MethodPost, "/api/v1/backends/"+url.PathEscape(address)+"/"+action, &backend)
+	return backend, err
+}
+
+func (c *AdminClient) do(ctx context.Context, method, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s: %s", resp.Status, e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package hacox
+
+import (
+	"math/rand"
+	"net"
+)
+
+// Balancer selects the backend of a new connection.
+type Balancer interface {
+	// Pick selects one of the backends, which are never empty, for a client
+	// connected through the local address.
+	Pick(backends []Backend, local net.Addr) Backend
+}
+
+// GroupBalancer selects a group of backends first by the weight of the
+// groups, so that an apiserver with several addresses is not selected more
+// often than the others, then prefers a backend of the group in the same ip
+// family as the local address.
+type GroupBalancer struct{}
+
+func (GroupBalancer) Pick(backends []Backend, local net.Addr) Backend {
+	var (
+		keys  []string
+		total int
+	)
+	groups := make(map[string][]Backend)
+	weights := make(map[string]int)
+	for _, backend := range backends {
+		group := backend.Group
+		if group == "" {
+			group = backend.Address
+		}
+		if _, ok := groups[group]; !ok {
+			keys = append(keys, group)
+		}
+		groups[group] = append(groups[group], backend)
+		if weight := max(backend.Weight, 1); weight > weights[group] {
+			total += weight - weights[group]
+			weights[group] = weight
+		}
+	}
+	n := rand.Intn(total)
+	for _, key := range keys {
+		n -= weights[key]
+		if n < 0 {
+			backends = groups[key]
+			break
+		}
+	}
+
+	if ipv4, ok := isIPv4Addr(local); ok {
+		var sameFamily []Backend
+		for _, backend := range backends {
+			if it, ok := isIPv4Backend(backend.Address); ok && it == ipv4 {
+				sameFamily = append(sameFamily, backend)
+			}
+		}
+		if len(sameFamily) > 0 {
+			backends = sameFamily
+		}
+	}
+
+	return backends[rand.Intn(len(backends))]
+}
+
+func isIPv4Addr(addr net.Addr) (bool, bool) {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || tcpAddr.IP == nil {
+		return false, false
+	}
+	return tcpAddr.IP.To4() != nil, true
+}
+
+func isIPv4Backend(backend string) (bool, bool) {
+	host, _, err := net.SplitHostPort(backend)
+	if err != nil {
+		return false, false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false, false
+	}
+	return ip.To4() != nil, true
+}
@@ -0,0 +1,143 @@
+package hacox
+
+import (
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// the warnings about the serving certificate of a backend
+const (
+	// CertWarningIPMissing is the dialed address of the backend is missing
+	// from the subject alternative names of the certificate.
+	CertWarningIPMissing = "ip_missing"
+	// CertWarningUnknownIssuer is the certificate is not issued by the
+	// cluster CA.
+	CertWarningUnknownIssuer = "unknown_issuer"
+)
+
+var certWarnings = []string{CertWarningIPMissing, CertWarningUnknownIssuer}
+
+// CertFunc receives the certificate chain presented by a backend, leaf
+// first.
+type CertFunc func(backend string, chain []*x509.Certificate)
+
+// CertStatus is the diagnosis of the serving certificate of a backend.
+type CertStatus struct {
+	// NotAfter is the earliest expiry of the certificates in the chain.
+	NotAfter time.Time
+	Warnings []string
+}
+
+// CertCheck diagnoses the serving certificates presented by the backends
+// while they are probed, see ReadyzProber.NotifyCerts. The probes skip the
+// verification of the certificates, so that a backend with a bad
+// certificate stays in use, but such a certificate usually breaks the
+// clients that do verify it after a control plane change.
+type CertCheck struct {
+	lock sync.RWMutex
+	// caFunc returns the cluster CA, nil if it is unknown.
+	caFunc func() *x509.CertPool
+	status map[string]CertStatus
+	log    *slog.Logger
+}
+
+func NewCertCheck(caFunc func() *x509.CertPool, logger *slog.Logger) *CertCheck {
+	return &CertCheck{
+		caFunc: caFunc,
+		status: make(map[string]CertStatus),
+		log:    componentLogger(logger, "health check"),
+	}
+}
+
+// Check diagnoses the certificate chain presented by the backend, and logs
+// the warnings when they change.
+func (c *CertCheck) Check(backend string, chain []*x509.Certificate) {
+	if len(chain) == 0 {
+		return
+	}
+	leaf := chain[0]
+
+	status := CertStatus{NotAfter: leaf.NotAfter}
+	for _, cert := range chain[1:] {
+		if cert.NotAfter.Before(status.NotAfter) {
+			status.NotAfter = cert.NotAfter
+		}
+	}
+
+	if host, _, err := net.SplitHostPort(backend); err == nil && leaf.VerifyHostname(host) != nil {
+		status.Warnings = append(status.Warnings, CertWarningIPMissing)
+	}
+	if c.caFunc != nil {
+		if roots := c.caFunc(); roots != nil && !issuedBy(chain, roots) {
+			status.Warnings = append(status.Warnings, CertWarningUnknownIssuer)
+		}
+	}
+
+	c.lock.Lock()
+	old, ok := c.status[backend]
+	c.status[backend] = status
+	c.lock.Unlock()
+
+	for _, warning := range status.Warnings {
+		if slices.Contains(old.Warnings, warning) {
+			continue
+		}
+		switch warning {
+		case CertWarningIPMissing:
+			c.log.Warn("backend certificate does not include the dialed address", "backend", backend, "ips", leaf.IPAddresses, "dnsNames", leaf.DNSNames)
+		case CertWarningUnknownIssuer:
+			c.log.Warn("backend certificate is not issued by the cluster CA", "backend", backend, "issuer", leaf.Issuer.String())
+		}
+	}
+	if ok && len(old.Warnings) > 0 && len(status.Warnings) == 0 {
+		c.log.Info("backend certificate is valid again", "backend", backend)
+	}
+}
+
+// issuedBy reports whether the chain leads to one of the roots. The chain is
+// verified at the time the leaf was issued, since Verify checks the validity
+// period before the issuer, and the expiry is left to the expiry metric.
+func issuedBy(chain []*x509.Certificate, roots *x509.CertPool) bool {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   chain[0].NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	var unknownAuthority x509.UnknownAuthorityError
+	return !errors.As(err, &unknownAuthority)
+}
+
+// GetCertsStatus returns the status of the certificates of the backends
+// probed so far.
+func (c *CertCheck) GetCertsStatus() map[string]CertStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	r := make(map[string]CertStatus, len(c.status))
+	for backend, status := range c.status {
+		status.Warnings = slices.Clone(status.Warnings)
+		r[backend] = status
+	}
+	return r
+}
+
+// OnBackendEvent forgets the certificates of the removed backends.
+func (c *CertCheck) OnBackendEvent(event BackendEvent) {
+	if event.Type != BackendRemoved {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.status, event.Backend.Address)
+}
@@ -0,0 +1,145 @@
+package hacox
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Process is the local process a client connection belongs to.
+type Process struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+	Cgroup  string `json:"cgroup,omitempty"`
+	// PodUID is the uid of the pod the process runs in, found in its cgroup.
+	PodUID string `json:"podUID,omitempty"`
+}
+
+// Connection is a client connection proxied to a backend.
+type Connection struct {
+	Client string `json:"client"`
+	// Local is the listen address the client connected to.
+	Local string `json:"local"`
+	// Upstream is the local address of the connection to the backend.
+	Upstream string    `json:"upstream"`
+	Backend  string    `json:"backend"`
+	Started  time.Time `json:"started"`
+	// BytesIn are received from the client and BytesOut are sent to it.
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	// Process is the local process of the client, nil if the client is not
+	// local or the process can not be found.
+	Process *Process `json:"process,omitempty"`
+}
+
+// clientConn is the state of a proxied client connection.
+type clientConn struct {
+	client   net.Addr
+	local    net.Addr
+	upstream net.Addr
+	backend  string
+	started  time.Time
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// reason is why the connection was closed, the first one wins.
+	reason atomic.Pointer[string]
+}
+
+// close records why the connection is closed, unless it is already closed.
+func (c *clientConn) close(reason string) {
+	c.reason.CompareAndSwap(nil, &reason)
+}
+
+func (c *clientConn) connection() Connection {
+	var upstream string
+	if c.upstream != nil {
+		upstream = c.upstream.String()
+	}
+	return Connection{
+		Client:   c.client.String(),
+		Local:    c.local.String(),
+		Upstream: upstream,
+		Backend:  c.backend,
+		Started:  c.started,
+		BytesIn:  c.bytesIn.Load(),
+		BytesOut: c.bytesOut.Load(),
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+func (c *clientConn) accessLogEntry() AccessLogEntry {
+	conn := c.connection()
+	entry := AccessLogEntry{
+		Client:   conn.Client,
+		Local:    conn.Local,
+		Upstream: conn.Upstream,
+		Backend:  conn.Backend,
+		Start:    conn.Started,
+		End:      time.Now(),
+		BytesIn:  conn.BytesIn,
+		BytesOut: conn.BytesOut,
+	}
+	if reason := c.reason.Load(); reason != nil {
+		entry.Reason = *reason
+	}
+	return entry
+}
+
+func (p *Proxy) addClient(c *clientConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.clients[c] = struct{}{}
+}
+
+func (p *Proxy) delClient(c *clientConn) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	delete(p.clients, c)
+}
+
+// Connections returns the client connections sorted by when they started.
+// With processes, the local processes of the clients are looked up, which
+// is only supported on Linux and walks every process.
+func (p *Proxy) Connections(processes bool) []Connection {
+	p.lock.RLock()
+	conns := make([]Connection, 0, len(p.clients))
+	for c := range p.clients {
+		conns = append(conns, c.connection())
+	}
+	p.lock.RUnlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Started.Before(conns[j].Started) })
+	if processes {
+		lookupProcesses(conns, p.log)
+	}
+	return conns
+}
+
+// GetProcessesClientsCount returns the number of client connections of each
+// local process command, "unknown" for the clients without a process.
+func (p *Proxy) GetProcessesClientsCount() map[string]int {
+	counts := make(map[string]int)
+	for _, conn := range p.Connections(true) {
+		command := "unknown"
+		if conn.Process != nil {
+			command = conn.Process.Command
+		}
+		counts[command]++
+	}
+	return counts
+}
@@ -0,0 +1,155 @@
+package hacox
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// fromClusterConsensus gets the servers from up to ConsensusServers
+// apiservers in parallel, through one address of each, and keeps only the
+// addresses reported by a majority of the apiservers that answered. It fails
+// unless a majority of the apiservers queried answered. The apiservers
+// queried rotate between the discoveries.
+func (sc *ServersConfig) fromClusterConsensus() (*clusterHosts, error) {
+	sample := sc.consensusSample()
+	n := len(sample)
+	if n == 0 {
+		return nil, fmt.Errorf("no server found")
+	}
+
+	var (
+		wg      sync.WaitGroup
+		lock    sync.Mutex
+		results = make(map[string]*clusterHosts)
+		errs    []error
+	)
+	for _, idx := range sample {
+		server := sc.servers[idx]
+		group := sc.entries[idx].group()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hosts, err := sc.fetchFromServer(idx)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				sc.log.Warn("get servers from cluster error", "server", server, "error", err)
+				errs = append(errs, err)
+				return
+			}
+			results[group] = hosts
+		}()
+	}
+	wg.Wait()
+
+	if len(results)*2 <= n {
+		return nil, fmt.Errorf("only %d of %d servers answered, no quorum: %v", len(results), n, errs)
+	}
+	if len(results) < n {
+		sc.log.Warn("not all servers answered the discovery", "answered", len(results), "servers", n)
+	}
+
+	r, disagreements := vote(results, sc.log)
+
+	sc.lock.Lock()
+	sc.disagreements = disagreements
+	sc.lock.Unlock()
+
+	return r, nil
+}
+
+// vote keeps the addresses reported by a majority of the results, keyed by
+// the apiserver that answered, and returns the number of apiservers that did
+// not report each address not all of them agreed on.
+func vote(results map[string]*clusterHosts, log *slog.Logger) (*clusterHosts, map[string]int) {
+	// each apiserver votes once, whichever of its addresses answered
+	reporters := make(map[string][]string)
+	for group, hosts := range results {
+		for _, address := range hosts.servers() {
+			reporters[address] = append(reporters[address], group)
+		}
+	}
+
+	groups := make([]string, 0, len(results))
+	for group := range results {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	r := newClusterHosts()
+	disagreements := make(map[string]int)
+	for _, group := range groups {
+		hosts := results[group]
+		for node, addresses := range hosts.nodes {
+			for _, address := range addresses {
+				if len(reporters[address])*2 > len(results) {
+					r.add(node, address, hosts.sources[address])
+				}
+			}
+			if zone, ok := hosts.zones[node]; ok {
+				r.zones[node] = zone
+			}
+		}
+		for hostname, node := range hosts.aliases {
+			r.alias(hostname, node)
+		}
+		maps.Copy(r.skipped, hosts.skipped)
+	}
+
+	for address, servers := range reporters {
+		if len(servers) == len(results) {
+			continue
+		}
+		disagreements[address] = len(results) - len(servers)
+		action := "drop"
+		if len(servers)*2 > len(results) {
+			action = "keep"
+		}
+		slices.Sort(servers)
+		log.Warn("discovery disagreement", "action", action, "address", address, "reporters", servers, "answered", len(results))
+	}
+	return r, disagreements
+}
+
+// consensusSample returns the indexes of the servers a consensus discovery
+// queries, one address of each apiserver, starting from consensusNext.
+func (sc *ServersConfig) consensusSample() []int {
+	var (
+		sample []int
+		seen   = make(map[string]bool)
+		last   int
+	)
+	for i := range sc.disorder {
+		pos := (sc.consensusNext + i) % len(sc.disorder)
+		idx := sc.disorder[pos]
+		group := sc.entries[idx].group()
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+		sample = append(sample, idx)
+		last = pos
+		if len(sample) == sc.safeguards.ConsensusServers {
+			break
+		}
+	}
+	if len(sample) > 0 {
+		sc.consensusNext = last + 1
+	}
+	return sample
+}
+
+// GetDisagreements returns the number of servers that did not report each
+// address in the last consensus discovery, for the addresses that not all
+// servers agreed on.
+func (sc *ServersConfig) GetDisagreements() map[string]int {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
+	return maps.Clone(sc.disagreements)
+}
@@ -0,0 +1,198 @@
+package hacox
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// testHosts returns the hosts of the addresses keyed by node.
+func testHosts(nodes map[string][]string) *clusterHosts {
+	hosts := newClusterHosts()
+	for node, addresses := range nodes {
+		for _, address := range addresses {
+			hosts.add(node, address, SourceNode)
+		}
+	}
+	return hosts
+}
+
+func TestVote(t *testing.T) {
+	tests := []struct {
+		name          string
+		results       map[string]*clusterHosts
+		want          []string
+		disagreements map[string]int
+	}{
+		{
+			name: "all agree",
+			results: map[string]*clusterHosts{
+				"m1": testHosts(map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}}),
+				"m2": testHosts(map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}}),
+			},
+			want:          []string{"10.0.0.1", "10.0.0.2"},
+			disagreements: map[string]int{},
+		},
+		{
+			name: "majority keeps an address",
+			results: map[string]*clusterHosts{
+				"m1": testHosts(map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}}),
+				"m2": testHosts(map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}}),
+				"m3": testHosts(map[string][]string{"m1": {"10.0.0.1"}}),
+			},
+			want:          []string{"10.0.0.1", "10.0.0.2"},
+			disagreements: map[string]int{"10.0.0.2": 1},
+		},
+		{
+			name: "minority drops an address",
+			results: map[string]*clusterHosts{
+				"m1": testHosts(map[string][]string{"m1": {"10.0.0.1"}, "x": {"10.0.0.9"}}),
+				"m2": testHosts(map[string][]string{"m1": {"10.0.0.1"}}),
+				"m3": testHosts(map[string][]string{"m1": {"10.0.0.1"}}),
+			},
+			want:          []string{"10.0.0.1"},
+			disagreements: map[string]int{"10.0.0.9": 2},
+		},
+		{
+			name: "a tie drops an address",
+			results: map[string]*clusterHosts{
+				"m1": testHosts(map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}}),
+				"m2": testHosts(map[string][]string{"m1": {"10.0.0.1"}}),
+			},
+			want:          []string{"10.0.0.1"},
+			disagreements: map[string]int{"10.0.0.2": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, disagreements := vote(tt.results, testLogger())
+			if got := hosts.servers(); !slices.Equal(got, tt.want) {
+				t.Errorf("servers = %v, want %v", got, tt.want)
+			}
+			if !maps.Equal(disagreements, tt.disagreements) {
+				t.Errorf("disagreements = %v, want %v", disagreements, tt.disagreements)
+			}
+		})
+	}
+}
+
+func TestConsensusSample(t *testing.T) {
+	entries := []ServerEntry{
+		{Address: "10.0.0.1", NodeName: "m1"},
+		{Address: "fd00::1", NodeName: "m1"},
+		{Address: "10.0.0.2", NodeName: "m2"},
+		{Address: "10.0.0.3", NodeName: "m3"},
+		{Address: "10.0.0.4"},
+	}
+	tests := []struct {
+		name    string
+		servers int
+		want    [][]int
+	}{
+		{
+			name:    "one address of each apiserver",
+			servers: 10,
+			want:    [][]int{{0, 2, 3, 4}, {0, 2, 3, 4}},
+		},
+		{
+			name:    "rotate",
+			servers: 2,
+			want:    [][]int{{0, 2}, {3, 4}, {0, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &ServersConfig{
+				entries:    entries,
+				disorder:   []int{0, 1, 2, 3, 4},
+				safeguards: Safeguards{ConsensusServers: tt.servers},
+			}
+			for i, want := range tt.want {
+				if got := sc.consensusSample(); !slices.Equal(got, want) {
+					t.Errorf("sample %d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+// fakeAPIServer serves the control-plane nodes, each with its name and
+// internal ip, or fails every request if nodes is nil.
+func fakeAPIServer(t *testing.T, nodes map[string]string) (string, int) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if nodes == nil {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var list NodeList
+		if strings.HasPrefix(r.URL.Path, "/api/v1/nodes") {
+			for name, ip := range nodes {
+				var node Node
+				node.Metadata.Name = name
+				node.Status.Addresses = []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: ip}}
+				list.Items = append(list.Items, node)
+			}
+		}
+		json.NewEncoder(w).Encode(&list)
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func TestFromClusterConsensusQuorum(t *testing.T) {
+	nodes := map[string]string{"m1": "10.0.0.1", "m2": "10.0.0.2", "m3": "10.0.0.3"}
+	tests := []struct {
+		name    string
+		failing int
+		wantErr bool
+	}{
+		{"all answer", 0, false},
+		{"a majority answers", 1, false},
+		{"a minority answers", 2, true},
+		{"none answers", 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &ServersConfig{
+				client: &http.Client{Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				}},
+				safeguards: Safeguards{ConsensusServers: 3},
+				log:        testLogger(),
+			}
+			for i, name := range []string{"m1", "m2", "m3"} {
+				served := nodes
+				if i < tt.failing {
+					served = nil
+				}
+				host, port := fakeAPIServer(t, served)
+				sc.entries = append(sc.entries, ServerEntry{Address: host, Port: port, NodeName: name})
+				sc.servers = append(sc.servers, host)
+				sc.disorder = append(sc.disorder, i)
+			}
+
+			hosts, err := sc.fromClusterConsensus()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(hosts.servers()) != len(nodes) {
+				t.Errorf("servers = %v, want %d", hosts.servers(), len(nodes))
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package hacox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// the reasons of the Events about the Node
+const (
+	EventBackendUnhealthy   = "BackendUnhealthy"
+	EventBackendHealthy     = "BackendHealthy"
+	EventServerDiscovered   = "ServerDiscovered"
+	EventServerRemoved      = "ServerRemoved"
+	EventNoBackendAvailable = "NoBackendAvailable"
+	EventBackendAvailable   = "BackendAvailable"
+	EventDiscoveryFailed    = "DiscoveryFailed"
+)
+
+const (
+	// eventsNamespace is where the Events about Nodes are, like the ones of
+	// the kubelet.
+	eventsNamespace = "default"
+	// eventsBurst Events are posted at most, and one more every
+	// eventsInterval, like the Event recorder of client-go.
+	eventsBurst    = 25
+	eventsInterval = 5 * time.Minute
+	// eventsDedupWindow is how long an Event is updated instead of posting
+	// an Event with the same reason and message.
+	eventsDedupWindow = 10 * time.Minute
+)
+
+type nodeEvent struct {
+	eventType string
+	reason    string
+	message   string
+}
+
+// sentEvent is an Event posted recently.
+type sentEvent struct {
+	name  string
+	count int32
+	last  time.Time
+}
+
+// EventRecorder posts Kubernetes Events about the Node hacox runs on when
+// the backends change, so that the cluster sees which nodes lost which
+// apiserver. The Events are posted to the available backends with the
+// credentials of the discovery. Repeated Events update the count of the
+// posted one, and the Events beyond the rate limit are dropped.
+type EventRecorder struct {
+	nodeName string
+	registry *Registry
+	do       func(req *http.Request) (*http.Response, error)
+	events   chan nodeEvent
+	// available reports whether a backend was available at the last change
+	// of the backends.
+	available bool
+	// discoveryFailed reports whether the last discovery failed.
+	discoveryFailed bool
+	sent            map[string]*sentEvent
+	tokens          float64
+	refilled        time.Time
+	log             *slog.Logger
+}
+
+// NewEventRecorder creates a recorder of the Events about the node nodeName,
+// sending the requests with do, such as ServersConfig.Do.
+func NewEventRecorder(nodeName string, registry *Registry, do func(req *http.Request) (*http.Response, error), logger *slog.Logger) *EventRecorder {
+	r := &EventRecorder{
+		nodeName:  nodeName,
+		registry:  registry,
+		do:        do,
+		events:    make(chan nodeEvent, 64),
+		available: availableBackends(registry) > 0,
+		sent:      make(map[string]*sentEvent),
+		tokens:    eventsBurst,
+		refilled:  time.Now(),
+		log:       componentLogger(logger, "events"),
+	}
+	registry.Subscribe(r.onEvent)
+	return r
+}
+
+func availableBackends(registry *Registry) int {
+	n := 0
+	for _, backend := range registry.List() {
+		if backend.Available() {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *EventRecorder) onEvent(event BackendEvent) {
+	b, old := event.Backend, event.Old
+	switch {
+	case event.Type == BackendAdded && !b.Standby:
+		r.record(corev1.EventTypeNormal, EventServerDiscovered, fmt.Sprintf("apiserver %s is discovered", b.Address))
+	case event.Type == BackendRemoved && !b.Standby:
+		r.record(corev1.EventTypeNormal, EventServerRemoved, fmt.Sprintf("apiserver %s is removed", b.Address))
+	case event.Type != BackendUpdated:
+	case b.Standby && !old.Standby:
+		r.record(corev1.EventTypeNormal, EventServerRemoved, fmt.Sprintf("apiserver %s is removed, kept as standby", b.Address))
+	case !b.Standby && old.Standby:
+		r.record(corev1.EventTypeNormal, EventServerDiscovered, fmt.Sprintf("apiserver %s is discovered again", b.Address))
+	case b.Standby:
+	case old.Healthy && !b.Healthy:
+		r.record(corev1.EventTypeWarning, EventBackendUnhealthy, fmt.Sprintf("apiserver %s is unhealthy", b.Address))
+	case !old.Healthy && b.Healthy:
+		r.record(corev1.EventTypeNormal, EventBackendHealthy, fmt.Sprintf("apiserver %s is healthy again", b.Address))
+	}
+
+	n := availableBackends(r.registry)
+	switch {
+	case r.available && n == 0:
+		r.record(corev1.EventTypeWarning, EventNoBackendAvailable, "no apiserver is available, using the standby ones if any")
+	case !r.available && n > 0:
+		r.record(corev1.EventTypeNormal, EventBackendAvailable, fmt.Sprintf("%d apiservers are available again", n))
+	}
+	r.available = n > 0
+}
+
+// OnRefresh records the first of consecutive failed discoveries, see
+// ServersConfig.NotifyRefreshes.
+func (r *EventRecorder) OnRefresh(discovered int, err error) {
+	if err != nil && !r.discoveryFailed {
+		r.record(corev1.EventTypeWarning, EventDiscoveryFailed, fmt.Sprintf("discover apiservers error: %v", err))
+	}
+	r.discoveryFailed = err != nil
+}
+
+// record queues an Event, which is dropped if too many are queued.
+func (r *EventRecorder) record(eventType, reason, message string) {
+	select {
+	case r.events <- nodeEvent{eventType: eventType, reason: reason, message: message}:
+	default:
+		r.log.Warn("drop event, too many queued", "reason", reason)
+	}
+}
+
+// Run posts the recorded Events until ctx is done.
+func (r *EventRecorder) Run(ctx context.Context) error {
+	for {
+		select {
+		case event := <-r.events:
+			if !r.allow(time.Now()) {
+				r.log.Warn("drop event, rate limited", "reason", event.reason)
+				continue
+			}
+			if err := r.post(ctx, event); err != nil {
+				r.log.Error("post event error", "reason", event.reason, "error", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// allow takes a token of the rate limit at now.
+func (r *EventRecorder) allow(now time.Time) bool {
+	r.tokens = min(eventsBurst, r.tokens+float64(now.Sub(r.refilled))/float64(eventsInterval))
+	r.refilled = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// post creates the Event, or updates the count of the same Event posted
+// recently.
+func (r *EventRecorder) post(ctx context.Context, event nodeEvent) error {
+	now := time.Now()
+	for key, sent := range r.sent {
+		if now.Sub(sent.last) > eventsDedupWindow {
+			delete(r.sent, key)
+		}
+	}
+
+	key := event.eventType + "/" + event.reason + "/" + event.message
+	if sent, ok := r.sent[key]; ok {
+		patch, _ := json.Marshal(map[string]any{
+			"count":         sent.count + 1,
+			"lastTimestamp": metav1.NewTime(now),
+		})
+		err := clusterRequest(ctx, r.registry, r.do, http.MethodPatch, "/api/v1/namespaces/"+eventsNamespace+"/events/"+sent.name, "application/merge-patch+json", patch)
+		if err == nil {
+			sent.count++
+			sent.last = now
+			return nil
+		}
+		if !isNotFound(err) {
+			return err
+		}
+		// the Event was garbage collected
+		delete(r.sent, key)
+	}
+
+	e := corev1.Event{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Event"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", r.nodeName, now.UnixNano()),
+			Namespace: eventsNamespace,
+		},
+		// the uid of a Node in the Events of the kubelet is its name
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Node",
+			Name:       r.nodeName,
+			UID:        types.UID(r.nodeName),
+		},
+		Reason:         event.reason,
+		Message:        event.message,
+		Type:           event.eventType,
+		Source:         corev1.EventSource{Component: "hacox", Host: r.nodeName},
+		FirstTimestamp: metav1.NewTime(now),
+		LastTimestamp:  metav1.NewTime(now),
+		Count:          1,
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := clusterRequest(ctx, r.registry, r.do, http.MethodPost, "/api/v1/namespaces/"+eventsNamespace+"/events", "application/json", body); err != nil {
+		return err
+	}
+	r.sent[key] = &sentEvent{name: e.Name, count: 1, last: now}
+	return nil
+}
@@ -0,0 +1,98 @@
+package hacox
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const backupSuffix = ".bak"
+
+// writeFileAtomic writes data to a temporary file in the directory of path,
+// syncs it and renames it to path, so that path is either the old or the new
+// content even if the process crashes or the disk is full.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir, name := filepath.Split(path)
+	f, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+func syncDir(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeServersFile writes the encoded servers config to path while holding
+// the lock of path. The current content is kept as the backup first if it is
+// a valid servers config.
+func writeServersFile(path string, data []byte, log *slog.Logger) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(path, true)
+	if err != nil {
+		return fmt.Errorf("lock %s error: %v", path, err)
+	}
+	defer unlock()
+
+	if current, err := os.ReadFile(path); err == nil && !bytes.Equal(current, data) {
+		if _, _, err := decodeServers(bytes.NewReader(current)); err == nil {
+			if err := writeFileAtomic(path+backupSuffix, current, 0644); err != nil {
+				log.Warn("write backup error", "path", path, "error", err)
+			}
+		}
+	}
+
+	return writeFileAtomic(path, data, 0644)
+}
+
+// readServersFile reads path while holding the lock of path.
+func readServersFile(path string) ([]byte, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	unlock, err := lockFile(path, false)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s error: %v", path, err)
+	}
+	defer unlock()
+
+	return os.ReadFile(path)
+}
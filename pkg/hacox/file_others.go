@@ -0,0 +1,17 @@
+//go:build !linux
+
+package hacox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+func lockFile(path string, exclusive bool) (func(), error) {
+	return func() {}, nil
+}
+
+func watchFile(ctx context.Context, path string, log *slog.Logger) (<-chan struct{}, error) {
+	return nil, fmt.Errorf("watching files is not supported on this platform")
+}
@@ -0,0 +1,86 @@
+package hacox
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+type DiscoveryFilter struct {
+	SkipNotReadyNodes    bool
+	SkipCordonedNodes    bool
+	SkipTerminatingNodes bool
+	SkipTerminatingPods  bool
+	SkipNotRunningPods   bool
+	SkipNotReadyPods     bool
+}
+
+func DefaultDiscoveryFilter() DiscoveryFilter {
+	return DiscoveryFilter{
+		SkipNotReadyNodes:    true,
+		SkipTerminatingNodes: true,
+		SkipTerminatingPods:  true,
+		SkipNotRunningPods:   true,
+		SkipNotReadyPods:     true,
+	}
+}
+
+// nodeSkipReason returns why the node should be excluded from discovery,
+// or an empty string if it should be kept.
+func (f *DiscoveryFilter) nodeSkipReason(node *Node) string {
+	if f == nil {
+		return ""
+	}
+
+	if f.SkipTerminatingNodes && node.Metadata.DeletionTimestamp != nil {
+		return "node is terminating"
+	}
+
+	if f.SkipCordonedNodes && node.Spec.Unschedulable {
+		return "node is cordoned"
+	}
+
+	if f.SkipNotReadyNodes {
+		ready := false
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == corev1.NodeReady {
+				ready = cond.Status == corev1.ConditionTrue
+				break
+			}
+		}
+		if !ready {
+			return "node is not ready"
+		}
+	}
+
+	return ""
+}
+
+// podSkipReason returns why the pod should be excluded from discovery,
+// or an empty string if it should be kept.
+func (f *DiscoveryFilter) podSkipReason(pod *Pod) string {
+	if f == nil {
+		return ""
+	}
+
+	if f.SkipTerminatingPods && pod.Metadata.DeletionTimestamp != nil {
+		return "pod is terminating"
+	}
+
+	if f.SkipNotRunningPods && pod.Status.Phase != corev1.PodRunning {
+		return "pod phase is " + string(pod.Status.Phase)
+	}
+
+	if f.SkipNotReadyPods {
+		ready := false
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == corev1.PodReady {
+				ready = cond.Status == corev1.ConditionTrue
+				break
+			}
+		}
+		if !ready {
+			return "pod is not ready"
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,302 @@
+package hacox
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+)
+
+// Discovery discovers the backends.
+type Discovery interface {
+	// Run keeps the backends of the registry up to date until ctx is done.
+	Run(ctx context.Context, registry *Registry) error
+}
+
+// Refresher is implemented by a Discovery that can discover the backends on
+// request, such as the built-in discovery.
+type Refresher interface {
+	Refresh()
+}
+
+// Hacox proxies the connections of its listeners to the healthy backends.
+type Hacox struct {
+	registry  *Registry
+	discovery Discovery
+	hc        *HealthCheck
+	proxy     *Proxy
+	metrics   *Metrics
+	admin     *Admin
+	events    *EventRecorder
+	condition *NodeCondition
+	handoff   *handoff
+	accessLog io.Closer
+	opts      Options
+	log       *slog.Logger
+	// started beats once when Run starts.
+	started heartbeat
+}
+
+// New creates hacox with the options. With the built-in discovery, the
+// servers config is loaded, or bootstrapped from the seeds, before New
+// returns.
+func New(opts Options) (*Hacox, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if opts.LogRateBurst > 0 {
+		logger = slog.New(NewRateLimitHandler(logger.Handler(), opts.LogRateInterval, opts.LogRateBurst))
+	}
+
+	addrs := slices.Clone(opts.ListenAddrs)
+	for _, listener := range opts.Listeners {
+		addrs = append(addrs, listener.Addr().String())
+	}
+	logger.Info("starting hacox",
+		"addresses", addrs,
+		"unhealthyCountThreshold", opts.UnHealthyCountThreshold,
+		"checkInterval", opts.CheckInterval,
+		"standbyCheckInterval", opts.StandbyCheckInterval,
+		"backendPort", opts.BackendPort,
+		"metricsAddr", opts.MetricsAddr,
+		"adminAddr", opts.AdminAddr,
+		"shutdownGracePeriod", opts.ShutdownGracePeriod,
+		"handoffSocket", opts.HandoffSocket,
+		"livenessTimeout", opts.LivenessTimeout,
+		"bindWhenReady", opts.BindWhenReady,
+		"accessLog", opts.AccessLog,
+		"nodeName", opts.NodeName,
+		"events", opts.Events,
+		"nodeCondition", opts.NodeCondition,
+	)
+
+	h := &Hacox{
+		registry:  NewRegistry(),
+		discovery: opts.Discovery,
+		opts:      opts,
+		log:       logger,
+	}
+
+	prober := opts.Prober
+	if prober == nil {
+		prober = NewReadyzProber()
+	}
+	var caFunc func() *x509.CertPool
+	balancer := opts.Balancer
+	if balancer == nil {
+		balancer = GroupBalancer{}
+	}
+	h.proxy = NewProxy(h.registry, balancer, logger, opts.ListenAddrs, opts.Listeners...)
+	h.proxy.DrainOnStop(opts.ShutdownGracePeriod)
+	if opts.AccessLog != "" {
+		w, err := OpenAccessLog(opts.AccessLog, int64(opts.AccessLogMaxSize)<<20, opts.AccessLogMaxBackups)
+		if err != nil {
+			return nil, fmt.Errorf("open access log error: %v", err)
+		}
+		h.accessLog = w
+		h.proxy.LogAccess(NewAccessLog(w, opts.AccessLogSampleRate, logger))
+	}
+	h.hc = NewHealthCheck(h.registry, prober, opts.CheckInterval, opts.StandbyCheckInterval, opts.UnHealthyCountThreshold, logger)
+	if opts.BindWhenReady {
+		h.proxy.BindWhen(func() bool { return h.checkBackends() == nil })
+	}
+
+	var (
+		getKubeConfigFunc    GetKubeConfigFunc
+		getDisagreementsFunc GetDisagreementsFunc
+	)
+	if h.discovery == nil {
+		sc, err := newServersConfig(opts, logger)
+		if err != nil {
+			return nil, err
+		}
+		sc.Register(h.registry)
+		h.discovery = sc
+		getKubeConfigFunc = sc.ActiveKubeConfig
+		getDisagreementsFunc = sc.GetDisagreements
+		caFunc = sc.ClusterCA
+	}
+
+	var getCertsFunc GetCertsFunc
+	if p, ok := prober.(*ReadyzProber); ok {
+		certs := NewCertCheck(caFunc, logger)
+		p.NotifyCerts(certs.Check)
+		h.registry.Subscribe(certs.OnBackendEvent)
+		getCertsFunc = certs.GetCertsStatus
+	}
+
+	var getProcessesFunc GetClientsCountFunc
+	if opts.ProcessMetrics {
+		getProcessesFunc = h.proxy.GetProcessesClientsCount
+	}
+	h.metrics = NewMetrics(MetricsOptions{
+		Addr:             opts.MetricsAddr,
+		GetClientsCount:  h.proxy.GetBackendsClientsCount,
+		GetHealthy:       h.registry.GetBackendsHealth,
+		GetStandby:       h.registry.GetStandbyHealth,
+		GetKubeConfig:    getKubeConfigFunc,
+		GetDisagreements: getDisagreementsFunc,
+		GetProcesses:     getProcessesFunc,
+		GetCerts:         getCertsFunc,
+		ConstLabels:      opts.MetricsLabels,
+	})
+	h.registry.Subscribe(h.metrics.OnBackendEvent)
+	h.hc.NotifyProbes(h.metrics.ObserveProbe)
+	h.proxy.NotifyDials(h.metrics.ObserveDial)
+	sc, builtin := h.discovery.(*ServersConfig)
+	if builtin {
+		sc.NotifyRequests(h.metrics.ObserveDiscoveryRequest)
+		sc.NotifyRefreshes(h.metrics.ObserveRefresh)
+	}
+	h.metrics.Handle("/healthz", checkHandler(h.CheckLiveness))
+	h.metrics.Handle("/readyz", checkHandler(h.CheckReadiness))
+	if opts.MetricsRegisterer != nil {
+		if err := opts.MetricsRegisterer.Register(h.metrics); err != nil {
+			return nil, fmt.Errorf("register metrics error: %v", err)
+		}
+	}
+
+	if opts.Events {
+		// the Events are posted with the credentials of the discovery
+		if !builtin {
+			return nil, fmt.Errorf("the events need the built-in discovery")
+		}
+		h.events = NewEventRecorder(opts.NodeName, h.registry, sc.Do, logger)
+		sc.NotifyRefreshes(h.events.OnRefresh)
+	}
+	if opts.NodeCondition {
+		// the Node is updated with the credentials of the discovery
+		if !builtin {
+			return nil, fmt.Errorf("the node condition needs the built-in discovery")
+		}
+		h.condition = NewNodeCondition(opts.NodeName, h.registry, sc.Do, logger)
+	}
+
+	if opts.AdminAddr != "" {
+		var refreshFunc func()
+		if r, ok := h.discovery.(Refresher); ok {
+			refreshFunc = r.Refresh
+		}
+		h.admin = NewAdmin(opts.AdminAddr, h.registry, h.proxy, h.hc, refreshFunc, logger)
+	}
+
+	if opts.HandoffSocket != "" {
+		h.handoff = &handoff{path: opts.HandoffSocket, log: componentLogger(logger, "handoff")}
+		if opts.MetricsAddr != "" {
+			h.handoff.register("metrics", &h.metrics.serverListener)
+		}
+		if h.admin != nil {
+			h.handoff.register("admin", &h.admin.serverListener)
+		}
+		// taken over last, so that the predecessor keeps serving while the
+		// discovery bootstraps
+		listeners, err := h.handoff.takeOver()
+		if err != nil {
+			h.handoff.log.Error("take over listeners error", "path", opts.HandoffSocket, "error", err)
+		}
+		h.proxy.Inherit(listeners)
+	}
+
+	return h, nil
+}
+
+func newServersConfig(opts Options, logger *slog.Logger) (*ServersConfig, error) {
+	logger.Info("starting discovery",
+		"component", "discovery",
+		"refreshInterval", opts.RefreshInterval,
+		"leaseCheckInterval", opts.LeaseCheckInterval,
+		"leaseStaleThreshold", opts.LeaseStaleThreshold,
+		"standbyTTL", opts.StandbyTTL,
+		"kubeConfigPaths", opts.KubeConfigPaths,
+		"serversConfigPath", opts.ServersConfigPath,
+		"filter", opts.Filter,
+		"seeds", opts.Seeds,
+		"safeguards", opts.Safeguards,
+	)
+
+	sc, err := NewServersConfig(opts.ServersConfigPath, opts.KubeConfigPaths, opts.BackendPort, opts.RefreshInterval, opts.Filter, opts.AddressPolicy, opts.Seeds, opts.Safeguards, logger)
+	if err != nil {
+		return nil, err
+	}
+	sc.WatchLeases(opts.LeaseCheckInterval, opts.LeaseStaleThreshold)
+	sc.KeepStandby(opts.StandbyTTL)
+	return sc, nil
+}
+
+// Registry returns the registry of the backends.
+func (h *Hacox) Registry() *Registry {
+	return h.registry
+}
+
+// Run runs hacox until ctx is done or a component fails. When ctx is done,
+// the proxy stops accepting connections and drains them within the shutdown
+// grace period while the other components keep running, then everything
+// stops and Run returns nil. When a component fails, everything stops and
+// Run returns a *ComponentError of the first failed component.
+func (h *Hacox) Run(ctx context.Context) error {
+	h.started.beat()
+	proxyCtx, stopProxy := context.WithCancel(ctx)
+	defer stopProxy()
+	componentsCtx, stopComponents := context.WithCancel(context.Background())
+	defer stopComponents()
+
+	s := newSupervisor(func() {
+		stopProxy()
+		stopComponents()
+	}, h.log)
+	s.Go(proxyCtx, "proxy", func(ctx context.Context) error {
+		err := h.proxy.Start(ctx)
+		// the other components are only needed until the proxy is drained
+		stopComponents()
+		return err
+	})
+	s.Go(componentsCtx, "discovery", func(ctx context.Context) error {
+		return h.discovery.Run(ctx, h.registry)
+	})
+	s.Go(componentsCtx, "health check", h.hc.Start)
+	if h.opts.MetricsAddr != "" {
+		s.Go(componentsCtx, "metrics server", h.metrics.Start)
+	}
+	if h.admin != nil {
+		s.Go(componentsCtx, "admin server", h.admin.Start)
+	}
+	if h.events != nil {
+		s.Go(componentsCtx, "events", h.events.Run)
+	}
+	if h.condition != nil {
+		s.Go(componentsCtx, "node condition", h.condition.Run)
+	}
+	if h.handoff != nil {
+		s.Go(componentsCtx, "handoff", func(ctx context.Context) error {
+			return h.handoff.serve(ctx, h.proxy, stopProxy)
+		})
+	}
+
+	if h.opts.SystemdNotify {
+		n := &systemdNotifier{registry: h.registry, hc: h.hc, proxy: h.proxy, checkReady: h.CheckReadiness, log: componentLogger(h.log, "systemd")}
+		s.Go(componentsCtx, "systemd notifier", n.Run)
+	}
+
+	h.log.Info("hacox started")
+	<-proxyCtx.Done()
+	if ctx.Err() != nil {
+		h.log.Info("shutting down")
+	}
+	if h.opts.SystemdNotify {
+		if err := sdNotify("STOPPING=1"); err != nil {
+			h.log.Error("notify systemd error", "component", "systemd", "error", err)
+		}
+	}
+	err := s.Wait()
+	if h.accessLog != nil {
+		h.accessLog.Close()
+	}
+	h.log.Info("hacox stopped")
+	return err
+}
@@ -0,0 +1,283 @@
+package hacox
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	handoffTimeout  = 10 * time.Second
+	maxHandoffFiles = 64
+
+	handoffAccepted = "accepted"
+	handoffReleased = "released"
+)
+
+// handoffMessage is sent along with the files of the listeners, in the same
+// order, the listeners of the proxy first.
+type handoffMessage struct {
+	Addrs   []string        `json:"addrs"`
+	Servers []handoffServer `json:"servers,omitempty"`
+}
+
+// handoffServer is a listener of a server other than the proxy, such as the
+// metrics server.
+type handoffServer struct {
+	Name string `json:"name"`
+	Addr string `json:"addr"`
+}
+
+// serverListener is the listener of an http server that is handed over along
+// with the listeners of the proxy, so that the new process does not fail to
+// bind the address the old process keeps serving while it drains.
+type serverListener struct {
+	addr      string
+	lock      sync.Mutex
+	inherited net.Listener
+	bound     net.Listener
+}
+
+// listen returns the inherited listener, or listens on addr.
+func (s *serverListener) listen() (net.Listener, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	l := s.inherited
+	s.inherited = nil
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", s.addr); err != nil {
+			return nil, err
+		}
+	}
+	s.bound = l
+	return l, nil
+}
+
+// file returns a duplicate of the file of the listener, nil if it is not
+// listening.
+func (s *serverListener) file() (*os.File, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	filer, ok := s.bound.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, nil
+	}
+	return filer.File()
+}
+
+// handoff hands the listeners over between the processes of hacox through a
+// unix socket. The running process serves the socket, a new process connects
+// to it and receives the listeners, then the running process releases the
+// socket to the new process, stops accepting connections and drains.
+type handoff struct {
+	path    string
+	servers map[string]*serverListener
+	log     *slog.Logger
+}
+
+// takeOver takes over the listeners of the process serving the socket at
+// path, keyed by their listen address, and the listeners of the registered
+// servers. It returns once the process released them, so that it is called
+// when everything else is ready to serve them. No listener is taken over if
+// no process serves the socket.
+func (h *handoff) takeOver() (map[string]net.Listener, error) {
+	conn, err := net.DialTimeout("unix", h.path, handoffTimeout)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	uc := conn.(*net.UnixConn)
+	defer uc.Close()
+	uc.SetDeadline(time.Now().Add(handoffTimeout))
+
+	data, files, err := recvFiles(uc)
+	if err != nil {
+		return nil, fmt.Errorf("receive listeners error: %v", err)
+	}
+
+	var msg handoffMessage
+	if err := json.Unmarshal(data, &msg); err != nil || len(msg.Addrs)+len(msg.Servers) != len(files) {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, fmt.Errorf("invalid handoff message %q", data)
+	}
+
+	listeners := make(map[string]net.Listener)
+	servers := make(map[*serverListener]net.Listener)
+	for i, f := range files {
+		name, addr := "proxy", ""
+		if i < len(msg.Addrs) {
+			addr = msg.Addrs[i]
+		} else {
+			name, addr = msg.Servers[i-len(msg.Addrs)].Name, msg.Servers[i-len(msg.Addrs)].Addr
+		}
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			h.log.Error("take over listener error", "listener", addr, "server", name, "error", err)
+			continue
+		}
+		if i < len(msg.Addrs) {
+			listeners[addr] = listener
+		} else if s, ok := h.servers[name]; ok && s.addr == addr {
+			servers[s] = listener
+		} else {
+			// the server is disabled or moved in this process
+			listener.Close()
+			continue
+		}
+		h.log.Info("take over listener", "listener", addr, "server", name)
+	}
+
+	if err := accepted(uc); err != nil {
+		// the predecessor keeps serving the listeners
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		for _, listener := range servers {
+			listener.Close()
+		}
+		return nil, fmt.Errorf("wait for the predecessor to release the listeners error: %v", err)
+	}
+	for s, listener := range servers {
+		s.inherited = listener
+	}
+	return listeners, nil
+}
+
+// register hands the listener of the server over along with the listeners of
+// the proxy. The servers are registered before taking over the listeners, to
+// serve the listener of the same name and address taken over, if any.
+func (h *handoff) register(name string, s *serverListener) {
+	if h.servers == nil {
+		h.servers = make(map[string]*serverListener)
+	}
+	h.servers[name] = s
+}
+
+// serve serves the socket until ctx is done. After handing the listeners
+// over to a successor, it calls stop.
+func (h *handoff) serve(ctx context.Context, proxy *Proxy, stop func()) error {
+	// the socket file is left over if no process serves it
+	if err := os.Remove(h.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l, err := net.Listen("unix", h.path)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			h.log.Error("accept handoff connection error", "error", err)
+			continue
+		}
+
+		uc := conn.(*net.UnixConn)
+		if err := h.handOver(uc, proxy); err != nil {
+			h.log.Error("hand over listeners error", "error", err)
+			uc.Close()
+			continue
+		}
+
+		// release the socket to the successor
+		l.Close()
+		fmt.Fprintln(uc, handoffReleased)
+		uc.Close()
+		h.log.Info("listeners handed over")
+		stop()
+
+		<-ctx.Done()
+		return nil
+	}
+}
+
+// accepted tells the predecessor that the listeners are accepted and waits
+// for it to release them.
+func accepted(conn *net.UnixConn) error {
+	if _, err := fmt.Fprintln(conn, handoffAccepted); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != handoffReleased {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
+
+func (h *handoff) handOver(conn *net.UnixConn, proxy *Proxy) error {
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	addrs, files, err := proxy.ListenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	if len(files) == 0 {
+		return fmt.Errorf("no listener to hand over")
+	}
+
+	msg := handoffMessage{Addrs: addrs}
+	for name, s := range h.servers {
+		f, err := s.file()
+		if err != nil {
+			return fmt.Errorf("get file of the %s listener error: %v", name, err)
+		}
+		if f == nil {
+			continue
+		}
+		msg.Servers = append(msg.Servers, handoffServer{Name: name, Addr: s.addr})
+		files = append(files, f)
+	}
+	if len(files) > maxHandoffFiles {
+		return fmt.Errorf("too many listeners: %d", len(files))
+	}
+
+	data, err := json.Marshal(&msg)
+	if err != nil {
+		return err
+	}
+	if err := sendFiles(conn, data, files); err != nil {
+		return err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != handoffAccepted {
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package hacox
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func sendFiles(conn *net.UnixConn, data []byte, files []*os.File) error {
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		fds = append(fds, int(f.Fd()))
+	}
+	_, _, err := conn.WriteMsgUnix(data, unix.UnixRights(fds...), nil)
+	return err
+}
+
+func recvFiles(conn *net.UnixConn) ([]byte, []*os.File, error) {
+	buf := make([]byte, 64*1024)
+	oob := make([]byte, unix.CmsgSpace(maxHandoffFiles*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []*os.File
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "listener"))
+		}
+	}
+	// the files cut off are lost, and so are the ones that arrived
+	if flags&unix.MSG_CTRUNC != 0 {
+		for _, f := range files {
+			f.Close()
+		}
+		return nil, nil, fmt.Errorf("too many files in the message")
+	}
+	return buf[:n], files, nil
+}
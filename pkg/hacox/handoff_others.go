@@ -0,0 +1,17 @@
+//go:build !linux
+
+package hacox
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+func sendFiles(conn *net.UnixConn, data []byte, files []*os.File) error {
+	return fmt.Errorf("handing over listeners is not supported on this platform")
+}
+
+func recvFiles(conn *net.UnixConn) ([]byte, []*os.File, error) {
+	return nil, nil, fmt.Errorf("handing over listeners is not supported on this platform")
+}
@@ -4,10 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
-	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,28 +15,23 @@ const (
 	HealthCheckPath = "/readyz"
 )
 
-type NotifyFunc func(backend string, healthy bool)
+// Prober checks the health of a backend.
+type Prober interface {
+	Probe(ctx context.Context, backend string) error
+}
 
-type HealthCheck struct {
-	client                  *http.Client
-	lock                    sync.RWMutex
-	backends                []string
-	checkInterval           time.Duration
-	checking                map[string]struct{}
-	unHealthyCount          map[string]int
-	unHealthyCountThreshold int
-	isHealthy               map[string]bool
-	notiftyFunc             NotifyFunc
+// LatencyFunc receives how long an attempt to reach a backend took and its
+// error.
+type LatencyFunc func(backend string, latency time.Duration, err error)
+
+// ReadyzProber checks the health of a backend by its readyz endpoint.
+type ReadyzProber struct {
+	client    *http.Client
+	certFuncs []CertFunc
 }
 
-func NewHealthCheck(checkInterval time.Duration, unHealthyCountThreshold int, notifyfunc NotifyFunc) *HealthCheck {
-	return &HealthCheck{
-		checkInterval:           checkInterval,
-		unHealthyCountThreshold: unHealthyCountThreshold,
-		checking:                make(map[string]struct{}),
-		unHealthyCount:          make(map[string]int),
-		isHealthy:               make(map[string]bool),
-		notiftyFunc:             notifyfunc,
+func NewReadyzProber() *ReadyzProber {
+	return &ReadyzProber{
 		client: &http.Client{
 			Timeout: 5 * time.Second,
 			Transport: &http.Transport{
@@ -48,149 +43,259 @@ func NewHealthCheck(checkInterval time.Duration, unHealthyCountThreshold int, no
 	}
 }
 
-func (hc *HealthCheck) GetBackendsHealth() map[string]bool {
-	hc.lock.RLock()
-	defer hc.lock.RUnlock()
+// NotifyCerts registers the certFuncs to receive the certificate chain
+// presented by the backend on every probe.
+func (p *ReadyzProber) NotifyCerts(certFuncs ...CertFunc) {
+	p.certFuncs = append(p.certFuncs, certFuncs...)
+}
+
+func (p *ReadyzProber) Probe(ctx context.Context, backend string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("https://%s%s", backend, HealthCheckPath), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
-	health := make(map[string]bool)
-	for backend, healthy := range hc.isHealthy {
-		health[backend] = healthy
+	if resp.TLS != nil {
+		for _, f := range p.certFuncs {
+			if f != nil {
+				f(backend, resp.TLS.PeerCertificates)
+			}
+		}
 	}
 
-	return health
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check failed: %s", resp.Status)
+	}
+
+	return nil
+}
+
+type HealthCheck struct {
+	prober                  Prober
+	lock                    sync.Mutex
+	registry                *Registry
+	checkInterval           time.Duration
+	standbyCheckInterval    time.Duration
+	unHealthyCount          map[string]int
+	unHealthyCountThreshold int
+	lastCheck               atomic.Int64
+	heartbeat               heartbeat
+	probeC                  chan struct{}
+	probeFuncs              []LatencyFunc
+	log                     *slog.Logger
+}
+
+// NewHealthCheck creates a health check of the backends in the registry with
+// the prober. The standby backends are checked every standbyCheckInterval,
+// which is usually longer than checkInterval, and are not checked if it is 0.
+func NewHealthCheck(registry *Registry, prober Prober, checkInterval, standbyCheckInterval time.Duration, unHealthyCountThreshold int, logger *slog.Logger) *HealthCheck {
+	hc := &HealthCheck{
+		prober:                  prober,
+		registry:                registry,
+		checkInterval:           checkInterval,
+		standbyCheckInterval:    standbyCheckInterval,
+		unHealthyCountThreshold: unHealthyCountThreshold,
+		unHealthyCount:          make(map[string]int),
+		probeC:                  make(chan struct{}, 1),
+		log:                     componentLogger(logger, "health check"),
+	}
+	registry.Subscribe(hc.onEvent)
+	return hc
 }
 
 func (hc *HealthCheck) Start(ctx context.Context) error {
 	timer := time.NewTimer(hc.checkInterval)
 	defer timer.Stop()
 
+	var standbyC <-chan time.Time
+	if hc.standbyCheckInterval > 0 {
+		standbyTicker := time.NewTicker(hc.standbyCheckInterval)
+		defer standbyTicker.Stop()
+		standbyC = standbyTicker.C
+	}
+
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
 	for {
+		hc.heartbeat.beat()
 		select {
 		case <-timer.C:
-			for _, backend := range hc.backends {
-				if err := hc.check(backend); err != nil {
-					log.Printf("health check failed: %s", err)
-				}
-			}
+			hc.checkAll(ctx)
 			timer.Reset(hc.checkInterval)
+		case <-hc.probeC:
+			hc.checkAll(ctx)
+			hc.checkAllStandby(ctx)
+		case <-standbyC:
+			hc.checkAllStandby(ctx)
+		case <-heartbeatTicker.C:
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
-func (hc *HealthCheck) check(backend string) error {
-	hc.lock.Lock()
-	if _, ok := hc.checking[backend]; ok {
-		hc.lock.Unlock()
-		return nil
+// NotifyProbes registers the probeFuncs to receive the result of every
+// probe.
+func (hc *HealthCheck) NotifyProbes(probeFuncs ...LatencyFunc) {
+	hc.probeFuncs = append(hc.probeFuncs, probeFuncs...)
+}
+
+// LastHeartbeat returns when the loop of the health check last made
+// progress.
+func (hc *HealthCheck) LastHeartbeat() time.Time {
+	return hc.heartbeat.Last()
+}
+
+// ProbeNow requests checking all the backends, including the standby ones,
+// without waiting for the check interval.
+func (hc *HealthCheck) ProbeNow() {
+	select {
+	case hc.probeC <- struct{}{}:
+	default:
 	}
-	hc.checking[backend] = struct{}{}
-	hc.lock.Unlock()
+}
 
-	var err error
-	defer func() {
-		hc.updateStatue(backend, err)
-	}()
+// checkAll checks the backends in parallel, so that a round takes as long as
+// the slowest probe rather than all of them.
+func (hc *HealthCheck) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, backend := range hc.registry.List() {
+		if backend.Standby {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := hc.check(ctx, backend.Address); err != nil {
+				hc.log.Warn("health check failed", "backend", backend.Address, "error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	hc.lastCheck.Store(time.Now().UnixNano())
+}
 
-	resp, err := hc.client.Get(fmt.Sprintf("https://%s%s", backend, HealthCheckPath))
-	if err != nil {
-		return err
+func (hc *HealthCheck) checkAllStandby(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, backend := range hc.registry.List() {
+		if !backend.Standby {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hc.checkStandby(ctx, backend)
+		}()
 	}
-	defer resp.Body.Close()
+	wg.Wait()
+}
 
-	if resp.StatusCode != http.StatusOK {
-		err = fmt.Errorf("health check failed: %s", resp.Status)
-		return err
+// LastCheck returns when the last round of checking the backends finished,
+// or the zero time before the first round.
+func (hc *HealthCheck) LastCheck() time.Time {
+	if n := hc.lastCheck.Load(); n != 0 {
+		return time.Unix(0, n)
 	}
+	return time.Time{}
+}
 
-	return nil
+func (hc *HealthCheck) check(ctx context.Context, backend string) error {
+	err := hc.probe(ctx, backend)
+	hc.updateStatus(backend, err)
+	return err
+}
+
+func (hc *HealthCheck) probe(ctx context.Context, backend string) error {
+	start := time.Now()
+	err := hc.prober.Probe(ctx, backend)
+	hc.heartbeat.beat()
+	for _, f := range hc.probeFuncs {
+		if f != nil {
+			f(backend, time.Since(start), err)
+		}
+	}
+	return err
+}
+
+// checkStandby checks a standby backend, whose health follows a single check
+// since it is checked less often.
+func (hc *HealthCheck) checkStandby(ctx context.Context, backend Backend) {
+	err := hc.probe(ctx, backend.Address)
+	healthy := err == nil
+	if healthy == backend.Healthy {
+		return
+	}
+
+	if healthy {
+		hc.log.Info("backend is healthy", "backend", backend.Address, "standby", true)
+	} else {
+		hc.log.Warn("backend is unhealthy", "backend", backend.Address, "standby", true, "error", err)
+	}
+	hc.registry.SetHealthy(backend.Address, healthy)
 }
 
-func (hc *HealthCheck) updateStatue(backend string, err error) {
-	var healthy, stateChanged bool
+func (hc *HealthCheck) updateStatus(backend string, err error) {
+	state, ok := hc.registry.Get(backend)
+	if !ok {
+		return
+	}
 
+	var healthy bool
 	if err != nil {
-		stateChanged = hc.failed(backend)
-		healthy = false
-		if stateChanged {
-			log.Printf("health check %s failed: %s", backend, err)
+		healthy = !hc.failed(state)
+		if !healthy && state.Healthy {
+			hc.log.Warn("backend is unhealthy", "backend", backend, "error", err)
 		}
 	} else {
-		stateChanged = hc.success(backend)
+		hc.success(backend)
 		healthy = true
-		if stateChanged {
-			log.Printf("health check %s success", backend)
+		if !state.Healthy {
+			hc.log.Info("backend is healthy", "backend", backend)
 		}
 	}
 
-	if stateChanged && hc.notiftyFunc != nil {
-		hc.notiftyFunc(backend, healthy)
+	if healthy != state.Healthy {
+		hc.registry.SetHealthy(backend, healthy)
 	}
 }
 
-func (hc *HealthCheck) failed(backend string) bool {
+// failed counts a failed check of the backend and reports whether the
+// backend reached the unhealthy count threshold.
+func (hc *HealthCheck) failed(backend Backend) bool {
 	hc.lock.Lock()
 	defer hc.lock.Unlock()
 
-	delete(hc.checking, backend)
-	if hc.isHealthy[backend] {
-		hc.unHealthyCount[backend]++
+	if backend.Healthy {
+		hc.unHealthyCount[backend.Address]++
 	}
-	if hc.unHealthyCount[backend] >= hc.unHealthyCountThreshold {
-		if hc.isHealthy[backend] {
-			hc.isHealthy[backend] = false
-			return true
-		}
+	threshold := hc.unHealthyCountThreshold
+	if backend.Stale {
+		// the apiserver lease is stale, so a single failure is enough
+		threshold = 1
 	}
-	return false
+	return hc.unHealthyCount[backend.Address] >= threshold
 }
 
-func (hc *HealthCheck) success(backend string) bool {
+func (hc *HealthCheck) success(backend string) {
 	hc.lock.Lock()
 	defer hc.lock.Unlock()
 
-	delete(hc.checking, backend)
 	hc.unHealthyCount[backend] = 0
-	if !hc.isHealthy[backend] {
-		hc.isHealthy[backend] = true
-		return true
-	}
-	return false
 }
 
-func (hc *HealthCheck) UpdateBackends(backends []string) {
-	var oldBackends []string
-
-	hc.lock.Lock()
-	if slices.Equal(hc.backends, backends) {
-		hc.lock.Unlock()
+func (hc *HealthCheck) onEvent(event BackendEvent) {
+	if event.Type != BackendRemoved && event.Backend.Standby == event.Old.Standby {
 		return
 	}
-	oldBackends = slices.Clone(hc.backends)
-	hc.backends = slices.Clone(backends)
-	hc.lock.Unlock()
 
-	for _, it := range backends {
-		if !slices.Contains(oldBackends, it) {
-			hc.isHealthy[it] = true
-		}
-	}
-
-	var removed []string
-	for _, it := range oldBackends {
-		if !slices.Contains(backends, it) {
-			removed = append(removed, it)
-		}
-	}
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
 
-	for _, it := range removed {
-		hc.lock.Lock()
-		delete(hc.isHealthy, it)
-		delete(hc.unHealthyCount, it)
-		hc.lock.Unlock()
-		if hc.notiftyFunc != nil {
-			hc.notiftyFunc(it, false)
-		}
-	}
+	delete(hc.unHealthyCount, event.Backend.Address)
 }
@@ -0,0 +1,155 @@
+package hacox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	labelLeaseApiserverIdentity = "apiserver.kubernetes.io/identity=kube-apiserver"
+	labelLeaseHostname          = "kubernetes.io/hostname"
+)
+
+type StaleFunc func(backend string, stale bool)
+
+type leaseMonitor struct {
+	interval   time.Duration
+	threshold  time.Duration
+	staleFuncs []StaleFunc
+	stale      map[string]bool
+}
+
+type Lease struct {
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity string     `json:"holderIdentity"`
+		RenewTime      *time.Time `json:"renewTime"`
+	} `json:"spec"`
+}
+
+type LeaseList struct {
+	Items []Lease `json:"items"`
+}
+
+// WatchLeases enables checking the kube-apiserver identity leases every
+// interval. A backend whose lease has not been renewed within threshold is
+// reported as stale to the staleFuncs, and reported again once it recovers.
+func (sc *ServersConfig) WatchLeases(interval, threshold time.Duration, staleFuncs ...StaleFunc) {
+	if interval <= 0 || threshold <= 0 {
+		return
+	}
+
+	sc.leases = &leaseMonitor{
+		interval:   interval,
+		threshold:  threshold,
+		staleFuncs: staleFuncs,
+		stale:      make(map[string]bool),
+	}
+}
+
+func (sc *ServersConfig) checkLeases() error {
+	if err := sc.prepareAuthConfig(); err != nil {
+		sc.log.Error("prepare auth config error", "error", err)
+		return err
+	}
+
+	var (
+		err     error
+		renewed map[string]time.Time
+	)
+	for _, idx := range sc.disorder {
+		server := sc.servers[idx]
+		renewed, err = sc.fetchLeases(server, sc.portOf(idx))
+		if err != nil {
+			sc.log.Warn("get apiserver leases error", "server", server, "error", err)
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return err
+	}
+
+	stale := make(map[string]bool)
+	now := time.Now()
+	for hostname, renewTime := range renewed {
+		if now.Sub(renewTime) <= sc.leases.threshold {
+			continue
+		}
+		for _, ip := range sc.hosts.lookup(hostname) {
+			backend, ok := sc.backendOf(ip)
+			if !ok {
+				continue
+			}
+			stale[backend] = true
+			if !sc.leases.stale[backend] {
+				sc.log.Warn("apiserver lease is stale", "backend", backend, "hostname", hostname, "renewTime", renewTime.Format(time.RFC3339))
+			}
+		}
+	}
+
+	for backend := range sc.leases.stale {
+		if !stale[backend] {
+			sc.log.Info("apiserver lease is renewed", "backend", backend)
+			sc.notifyStale(backend, false)
+		}
+	}
+	for backend := range stale {
+		if !sc.leases.stale[backend] {
+			sc.notifyStale(backend, true)
+		}
+	}
+	sc.leases.stale = stale
+	return nil
+}
+
+func (sc *ServersConfig) notifyStale(backend string, stale bool) {
+	for _, f := range sc.leases.staleFuncs {
+		if f != nil {
+			f(backend, stale)
+		}
+	}
+}
+
+// fetchLeases returns the last renew time of the kube-apiserver identity
+// leases, keyed by the hostname of the holder.
+func (sc *ServersConfig) fetchLeases(server string, serverPort int) (map[string]time.Time, error) {
+	endpoint := fmt.Sprintf("https://%s:%d", wrapIPv6(server), serverPort)
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/kube-system/leases?labelSelector=%s", endpoint, labelLeaseApiserverIdentity)
+	resp, err := sc.request(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get leases from %s failed: %s", url, resp.Status)
+	}
+
+	return fromLeases(resp.Body)
+}
+
+func fromLeases(data io.ReadCloser) (map[string]time.Time, error) {
+	var leaseList LeaseList
+	if err := json.NewDecoder(data).Decode(&leaseList); err != nil {
+		return nil, err
+	}
+
+	r := make(map[string]time.Time)
+	for _, lease := range leaseList.Items {
+		hostname := lease.Metadata.Labels[labelLeaseHostname]
+		if hostname == "" || lease.Spec.RenewTime == nil {
+			continue
+		}
+		if last, ok := r[hostname]; !ok || lease.Spec.RenewTime.After(last) {
+			r[hostname] = *lease.Spec.RenewTime
+		}
+	}
+	return r, nil
+}
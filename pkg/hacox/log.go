@@ -0,0 +1,154 @@
+package hacox
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// componentLogger returns the logger of a component of hacox, from the
+// default logger of slog if logger is nil.
+func componentLogger(logger *slog.Logger, component string) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return logger.With("component", component)
+}
+
+// RateLimitHandler passes at most burst records with the same level, message
+// and subject in every interval to the handler it wraps, which is usually
+// enough to not miss a change while a loop keeps failing. The number of
+// dropped records is added to the next record that passes as the suppressed
+// attribute.
+type RateLimitHandler struct {
+	handler slog.Handler
+	// key identifies the attributes added by WithAttrs, such as the
+	// component, so that the same message of different components is
+	// limited separately.
+	key     string
+	limiter *rateLimiter
+}
+
+func NewRateLimitHandler(handler slog.Handler, interval time.Duration, burst int) *RateLimitHandler {
+	return &RateLimitHandler{
+		handler: handler,
+		limiter: &rateLimiter{
+			interval: interval,
+			burst:    burst,
+			windows:  make(map[string]*rateWindow),
+		},
+	}
+}
+
+func (h *RateLimitHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *RateLimitHandler) Handle(ctx context.Context, r slog.Record) error {
+	key := h.key + "|" + r.Level.String() + "|" + r.Message
+	r.Attrs(func(a slog.Attr) bool {
+		if rateLimitSubjects[a.Key] {
+			key += "|" + a.Key + "=" + a.Value.String()
+		}
+		return true
+	})
+
+	pass, suppressed := h.limiter.allow(key, r.Time)
+	if !pass {
+		return nil
+	}
+	if suppressed > 0 {
+		r = r.Clone()
+		r.AddAttrs(slog.Int("suppressed", suppressed))
+	}
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *RateLimitHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	key := h.key
+	for _, a := range attrs {
+		key += "|" + a.String()
+	}
+	return &RateLimitHandler{handler: h.handler.WithAttrs(attrs), key: key, limiter: h.limiter}
+}
+
+func (h *RateLimitHandler) WithGroup(name string) slog.Handler {
+	return &RateLimitHandler{handler: h.handler.WithGroup(name), key: h.key + "|" + name + ".", limiter: h.limiter}
+}
+
+// rateLimitSubjects are the attributes naming what a record is about, the
+// records of different subjects are limited separately.
+var rateLimitSubjects = map[string]bool{
+	"backend": true,
+	"server":  true,
+	"node":    true,
+	"pod":     true,
+	"address": true,
+}
+
+const (
+	// maxRateWindows is the number of keys above which the windows that
+	// ended are expired, at most once in every interval.
+	maxRateWindows = 1024
+	// suppressedWindows is the number of intervals after which a window with
+	// dropped records is expired, if no record of its key is logged since.
+	suppressedWindows = 10
+)
+
+type rateWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// rateLimiter counts the records of every key in fixed windows.
+type rateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	burst    int
+	windows  map[string]*rateWindow
+	expired  time.Time
+}
+
+// allow reports whether a record of key at now passes, and the number of the
+// records of key dropped since the last one that passed.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	w, ok := l.windows[key]
+	if !ok {
+		if len(l.windows) >= maxRateWindows && now.Sub(l.expired) >= l.interval {
+			l.expire(now)
+			l.expired = now
+		}
+		w = &rateWindow{start: now}
+		l.windows[key] = w
+	}
+	if now.Sub(w.start) >= l.interval {
+		w.start = now
+		w.count = 0
+	}
+	if w.count >= l.burst {
+		w.suppressed++
+		return false, 0
+	}
+
+	w.count++
+	suppressed := w.suppressed
+	w.suppressed = 0
+	return true, suppressed
+}
+
+// expire forgets the keys whose window ended without dropping a record, and
+// the keys that dropped records but have not been logged for
+// suppressedWindows intervals, whose number of dropped records is lost.
+func (l *rateLimiter) expire(now time.Time) {
+	for key, w := range l.windows {
+		age := now.Sub(w.start)
+		if age >= suppressedWindows*l.interval || w.suppressed == 0 && age >= l.interval {
+			delete(l.windows, key)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package hacox
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLogger returns a logger that discards the records.
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	type call struct {
+		key        string
+		at         time.Duration
+		pass       bool
+		suppressed int
+	}
+	tests := []struct {
+		name  string
+		burst int
+		calls []call
+	}{
+		{
+			name:  "burst",
+			burst: 2,
+			calls: []call{
+				{"a", 0, true, 0},
+				{"a", time.Second, true, 0},
+				{"a", 2 * time.Second, false, 0},
+				{"a", 3 * time.Second, false, 0},
+			},
+		},
+		{
+			name:  "suppressed added to the next record of the next window",
+			burst: 1,
+			calls: []call{
+				{"a", 0, true, 0},
+				{"a", time.Second, false, 0},
+				{"a", 2 * time.Second, false, 0},
+				{"a", time.Minute, true, 2},
+				{"a", 2 * time.Minute, true, 0},
+			},
+		},
+		{
+			name:  "keys limited separately",
+			burst: 1,
+			calls: []call{
+				{"a", 0, true, 0},
+				{"b", 0, true, 0},
+				{"a", time.Second, false, 0},
+				{"b", time.Second, false, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{interval: time.Minute, burst: tt.burst, windows: make(map[string]*rateWindow)}
+			for i, c := range tt.calls {
+				pass, suppressed := l.allow(c.key, start.Add(c.at))
+				if pass != c.pass || suppressed != c.suppressed {
+					t.Errorf("call %d: allow(%s, %s) = %v, %d, want %v, %d", i, c.key, c.at, pass, suppressed, c.pass, c.suppressed)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterExpire(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		age        time.Duration
+		suppressed int
+		expired    bool
+	}{
+		{"window not ended", 30 * time.Second, 0, false},
+		{"window ended", time.Minute, 0, true},
+		{"dropped records pending", time.Minute, 3, false},
+		{"dropped records expired", suppressedWindows * time.Minute, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &rateLimiter{interval: time.Minute, burst: 1, windows: map[string]*rateWindow{
+				"a": {start: start, count: 1, suppressed: tt.suppressed},
+			}}
+			l.expire(start.Add(tt.age))
+			if _, ok := l.windows["a"]; ok == tt.expired {
+				t.Errorf("expired = %v, want %v", !ok, tt.expired)
+			}
+		})
+	}
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		records [][]any
+		want    int
+	}{
+		{
+			name:    "same backend",
+			records: [][]any{{"backend", "a"}, {"backend", "a"}, {"backend", "a"}},
+			want:    1,
+		},
+		{
+			name:    "different backends",
+			records: [][]any{{"backend", "a"}, {"backend", "b"}, {"backend", "a"}},
+			want:    2,
+		},
+		{
+			name:    "different servers",
+			records: [][]any{{"server", "a"}, {"server", "b"}},
+			want:    2,
+		},
+		{
+			name:    "other attributes ignored",
+			records: [][]any{{"backend", "a", "error", "x"}, {"backend", "a", "error", "y"}},
+			want:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := slog.New(NewRateLimitHandler(slog.NewTextHandler(&buf, nil), time.Minute, 1))
+			for _, args := range tt.records {
+				logger.Log(context.Background(), slog.LevelError, "request error", args...)
+			}
+			if got := strings.Count(buf.String(), "\n"); got != tt.want {
+				t.Errorf("logged %d records, want %d:\n%s", got, tt.want, buf.String())
+			}
+		})
+	}
+}
@@ -3,75 +3,315 @@ package hacox
 import (
 	"context"
 	"net/http"
+	"slices"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	descBackendsCount  = prometheus.NewDesc("hacox_backends_count", "The number of backends", nil, nil)
-	descBackendsHealth = prometheus.NewDesc("hacox_backends_health", "The health of backends", []string{"backend"}, nil)
-	descClientsCount   = prometheus.NewDesc("hacox_clients_count", "The number of connected clients", []string{"backend"}, nil)
-)
+// metricsDescs are the descriptions of the metrics collected by Metrics
+// itself.
+type metricsDescs struct {
+	backendsCount  *prometheus.Desc
+	backendsHealth *prometheus.Desc
+	clientsCount   *prometheus.Desc
+	processClients *prometheus.Desc
+	kubeConfig     *prometheus.Desc
+	standbyHealth  *prometheus.Desc
+	disagreements  *prometheus.Desc
+	certExpiry     *prometheus.Desc
+	certWarning    *prometheus.Desc
+}
+
+func newMetricsDescs(constLabels prometheus.Labels) metricsDescs {
+	return metricsDescs{
+		backendsCount:  prometheus.NewDesc("hacox_backends_count", "The number of backends", nil, constLabels),
+		backendsHealth: prometheus.NewDesc("hacox_backends_health", "The health of backends", []string{"backend"}, constLabels),
+		clientsCount:   prometheus.NewDesc("hacox_clients_count", "The number of connected clients", []string{"backend"}, constLabels),
+		processClients: prometheus.NewDesc("hacox_client_connections", "The number of client connections of local processes", []string{"process"}, constLabels),
+		kubeConfig:     prometheus.NewDesc("hacox_kubeconfig_active", "The kubeconfig file in use", []string{"path"}, constLabels),
+		standbyHealth:  prometheus.NewDesc("hacox_standby_backends_health", "The health of standby backends", []string{"backend"}, constLabels),
+		disagreements:  prometheus.NewDesc("hacox_discovery_disagreements", "The number of servers that did not report the address in the last consensus discovery", []string{"address"}, constLabels),
+		certExpiry:     prometheus.NewDesc("hacox_backend_cert_expiry_timestamp_seconds", "The time the serving certificate chain of backends expires", []string{"backend"}, constLabels),
+		certWarning:    prometheus.NewDesc("hacox_backend_cert_warning", "Whether the serving certificate of backends has a problem", []string{"backend", "warning"}, constLabels),
+	}
+}
 
 type GetClientsCountFunc func() map[string]int
 type GetHealthyFunc func() map[string]bool
+type GetKubeConfigFunc func() string
+type GetDisagreementsFunc func() map[string]int
+type GetCertsFunc func() map[string]CertStatus
+
+// the values of the result label
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+// MetricsOptions are where the metrics come from. The getters other than
+// GetClientsCount and GetHealthy are optional, their metrics are not exported
+// if they are nil.
+type MetricsOptions struct {
+	// Addr is the listen address of the metrics server.
+	Addr             string
+	GetClientsCount  GetClientsCountFunc
+	GetHealthy       GetHealthyFunc
+	GetStandby       GetHealthyFunc
+	GetKubeConfig    GetKubeConfigFunc
+	GetDisagreements GetDisagreementsFunc
+	GetProcesses     GetClientsCountFunc
+	GetCerts         GetCertsFunc
+	// ConstLabels are added to all the metrics, so that the metrics of
+	// several instances of hacox can be registered on one registerer.
+	ConstLabels prometheus.Labels
+}
 
 type Metrics struct {
-	metricsAddr         string
-	getClientsCountFunc GetClientsCountFunc
-	getHealthyFunc      GetHealthyFunc
-	registry            *prometheus.Registry
+	serverListener
+	opts     MetricsOptions
+	descs    metricsDescs
+	registry *prometheus.Registry
+	mux      *http.ServeMux
+
+	healthTransitions    *prometheus.CounterVec
+	probeDuration        *prometheus.HistogramVec
+	dialDuration         *prometheus.HistogramVec
+	dialErrors           *prometheus.CounterVec
+	discoveryRequests    *prometheus.CounterVec
+	discoveryRequestTime *prometheus.GaugeVec
+	refreshes            *prometheus.CounterVec
+	refreshTime          *prometheus.GaugeVec
+	discoveredServers    prometheus.Gauge
 }
 
-func NewMetrics(metricsAddr string, getClientsCountFunc GetClientsCountFunc, getHealthyFunc GetHealthyFunc) *Metrics {
+func NewMetrics(opts MetricsOptions) *Metrics {
 	m := &Metrics{
-		metricsAddr:         metricsAddr,
-		getClientsCountFunc: getClientsCountFunc,
-		getHealthyFunc:      getHealthyFunc,
-		registry:            prometheus.NewRegistry(),
+		serverListener: serverListener{addr: opts.Addr},
+		opts:           opts,
+		descs:          newMetricsDescs(opts.ConstLabels),
+		registry:       prometheus.NewRegistry(),
+		mux:            http.NewServeMux(),
+		healthTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "hacox_backend_health_transitions_total",
+			Help:        "The number of health transitions of backends, up to healthy and down to unhealthy",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"backend", "direction"}),
+		probeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "hacox_backend_probe_duration_seconds",
+			Help:        "The duration of the health check probes of backends",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"backend", "result"}),
+		dialDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "hacox_backend_dial_duration_seconds",
+			Help:        "The duration of the successful dials to backends",
+			ConstLabels: opts.ConstLabels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"backend"}),
+		dialErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "hacox_backend_dial_errors_total",
+			Help:        "The number of failed dials to backends",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"backend"}),
+		discoveryRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "hacox_discovery_requests_total",
+			Help:        "The number of discovery requests to servers, by the source the server was discovered from",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"server", "source", "result"}),
+		discoveryRequestTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "hacox_discovery_last_request_timestamp_seconds",
+			Help:        "The time of the last discovery request to servers",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"server", "source", "result"}),
+		refreshes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "hacox_discovery_refreshes_total",
+			Help:        "The number of discoveries",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"result"}),
+		refreshTime: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "hacox_discovery_last_refresh_timestamp_seconds",
+			Help:        "The time of the last discovery",
+			ConstLabels: opts.ConstLabels,
+		}, []string{"result"}),
+		discoveredServers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "hacox_discovery_servers",
+			Help:        "The number of servers found by the last successful discovery",
+			ConstLabels: opts.ConstLabels,
+		}),
 	}
-	m.registry.MustRegister(m)
+	// the Go runtime and process metrics are only served by the metrics
+	// server, an embedding application registers its own
+	m.registry.MustRegister(m, collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	m.mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
 	return m
 }
 
+// Handle serves handler for pattern besides the metrics.
+func (m *Metrics) Handle(pattern string, handler http.Handler) {
+	m.mux.Handle(pattern, handler)
+}
+
+// OnBackendEvent counts the health changes of the backends.
+func (m *Metrics) OnBackendEvent(event BackendEvent) {
+	address := event.Backend.Address
+	switch {
+	case event.Type == BackendRemoved:
+		for _, vec := range []*prometheus.MetricVec{m.healthTransitions.MetricVec, m.probeDuration.MetricVec, m.dialDuration.MetricVec, m.dialErrors.MetricVec} {
+			vec.DeletePartialMatch(prometheus.Labels{"backend": address})
+		}
+		m.discoveryRequests.DeletePartialMatch(prometheus.Labels{"server": address})
+		m.discoveryRequestTime.DeletePartialMatch(prometheus.Labels{"server": address})
+	case event.Type == BackendUpdated && event.Backend.Healthy != event.Old.Healthy:
+		direction := "down"
+		if event.Backend.Healthy {
+			direction = "up"
+		}
+		m.healthTransitions.WithLabelValues(address, direction).Inc()
+	}
+}
+
+// ObserveProbe records a health check probe, see HealthCheck.NotifyProbes.
+func (m *Metrics) ObserveProbe(backend string, latency time.Duration, err error) {
+	m.probeDuration.WithLabelValues(backend, result(err)).Observe(latency.Seconds())
+}
+
+// ObserveDial records a dial to a backend, see Proxy.NotifyDials. Only the
+// duration of the successful dials is observed, the failed ones usually wait
+// for the dial timeout.
+func (m *Metrics) ObserveDial(backend string, latency time.Duration, err error) {
+	if err != nil {
+		m.dialErrors.WithLabelValues(backend).Inc()
+		return
+	}
+	m.dialDuration.WithLabelValues(backend).Observe(latency.Seconds())
+}
+
+// ObserveDiscoveryRequest records a discovery request to a server, see
+// ServersConfig.NotifyRequests.
+func (m *Metrics) ObserveDiscoveryRequest(server, source string, err error) {
+	m.discoveryRequests.WithLabelValues(server, source, result(err)).Inc()
+	m.discoveryRequestTime.WithLabelValues(server, source, result(err)).SetToCurrentTime()
+}
+
+// ObserveRefresh records a discovery, see ServersConfig.NotifyRefreshes.
+func (m *Metrics) ObserveRefresh(discovered int, err error) {
+	m.refreshes.WithLabelValues(result(err)).Inc()
+	m.refreshTime.WithLabelValues(result(err)).SetToCurrentTime()
+	if err == nil {
+		m.discoveredServers.Set(float64(discovered))
+	}
+}
+
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.healthTransitions,
+		m.probeDuration,
+		m.dialDuration,
+		m.dialErrors,
+		m.discoveryRequests,
+		m.discoveryRequestTime,
+		m.refreshes,
+		m.refreshTime,
+		m.discoveredServers,
+	}
+}
+
 func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
-	ch <- descBackendsCount
-	ch <- descBackendsHealth
-	ch <- descClientsCount
+	ch <- m.descs.backendsCount
+	ch <- m.descs.backendsHealth
+	ch <- m.descs.clientsCount
+	ch <- m.descs.processClients
+	ch <- m.descs.standbyHealth
+	ch <- m.descs.kubeConfig
+	ch <- m.descs.disagreements
+	ch <- m.descs.certExpiry
+	ch <- m.descs.certWarning
+	for _, c := range m.collectors() {
+		c.Describe(ch)
+	}
 }
 
 func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
-	if m.getClientsCountFunc == nil || m.getHealthyFunc == nil {
+	if m.opts.GetClientsCount == nil || m.opts.GetHealthy == nil {
 		return
 	}
 
-	for backend, count := range m.getClientsCountFunc() {
-		ch <- prometheus.MustNewConstMetric(descClientsCount, prometheus.GaugeValue, float64(count), backend)
+	for backend, count := range m.opts.GetClientsCount() {
+		ch <- prometheus.MustNewConstMetric(m.descs.clientsCount, prometheus.GaugeValue, float64(count), backend)
+	}
+
+	if m.opts.GetProcesses != nil {
+		for process, count := range m.opts.GetProcesses() {
+			ch <- prometheus.MustNewConstMetric(m.descs.processClients, prometheus.GaugeValue, float64(count), process)
+		}
 	}
 
 	n := 0
-	for backend, healthy := range m.getHealthyFunc() {
+	for backend, healthy := range m.opts.GetHealthy() {
 		n++
-		ch <- prometheus.MustNewConstMetric(descBackendsHealth, prometheus.GaugeValue, boolToFloat64(healthy), backend)
+		ch <- prometheus.MustNewConstMetric(m.descs.backendsHealth, prometheus.GaugeValue, boolToFloat64(healthy), backend)
+	}
+
+	ch <- prometheus.MustNewConstMetric(m.descs.backendsCount, prometheus.GaugeValue, float64(n))
+
+	if m.opts.GetStandby != nil {
+		for backend, healthy := range m.opts.GetStandby() {
+			ch <- prometheus.MustNewConstMetric(m.descs.standbyHealth, prometheus.GaugeValue, boolToFloat64(healthy), backend)
+		}
 	}
 
-	ch <- prometheus.MustNewConstMetric(descBackendsCount, prometheus.GaugeValue, float64(n))
+	if m.opts.GetKubeConfig != nil {
+		if path := m.opts.GetKubeConfig(); path != "" {
+			ch <- prometheus.MustNewConstMetric(m.descs.kubeConfig, prometheus.GaugeValue, 1, path)
+		}
+	}
 
+	if m.opts.GetDisagreements != nil {
+		for address, n := range m.opts.GetDisagreements() {
+			ch <- prometheus.MustNewConstMetric(m.descs.disagreements, prometheus.GaugeValue, float64(n), address)
+		}
+	}
+
+	if m.opts.GetCerts != nil {
+		for backend, status := range m.opts.GetCerts() {
+			ch <- prometheus.MustNewConstMetric(m.descs.certExpiry, prometheus.GaugeValue, float64(status.NotAfter.Unix()), backend)
+			for _, warning := range certWarnings {
+				ch <- prometheus.MustNewConstMetric(m.descs.certWarning, prometheus.GaugeValue, boolToFloat64(slices.Contains(status.Warnings, warning)), backend, warning)
+			}
+		}
+	}
+
+	for _, c := range m.collectors() {
+		c.Collect(ch)
+	}
 }
 
 func (m *Metrics) Start(ctx context.Context) error {
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
-
-	server := &http.Server{Addr: m.metricsAddr, Handler: mux}
+	l, err := m.listen()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: m.mux}
 
 	go func() {
 		<-ctx.Done()
 		server.Shutdown(context.Background())
 	}()
 
-	return server.ListenAndServe()
+	if err := server.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
 }
 
 func boolToFloat64(b bool) float64 {
@@ -0,0 +1,206 @@
+package hacox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// NodeConditionDegraded is the condition of the Node hacox runs on, which is
+// true while an apiserver is unhealthy or fewer than two are available.
+const NodeConditionDegraded corev1.NodeConditionType = "HacoxDegraded"
+
+// the reasons of the condition
+const (
+	ConditionBackendsHealthy   = "BackendsHealthy"
+	ConditionBackendsUnhealthy = "BackendsUnhealthy"
+	ConditionSingleBackend     = "SingleBackend"
+	ConditionNoBackendHealthy  = "NoBackendHealthy"
+)
+
+// the annotations of the Node
+const (
+	AnnotationHealthyBackends = "hacox.klusterdock.io/healthy-backends"
+	AnnotationTotalBackends   = "hacox.klusterdock.io/total-backends"
+	AnnotationLastChange      = "hacox.klusterdock.io/last-change"
+)
+
+const (
+	// nodeConditionMinInterval is the minimum interval between the updates
+	// of the Node.
+	nodeConditionMinInterval = 10 * time.Second
+	// nodeConditionHeartbeat is the interval of updating the Node when
+	// nothing changes, like node-problem-detector.
+	nodeConditionHeartbeat = 5 * time.Minute
+)
+
+// backendsCondition is the health of the backends reported on the Node,
+// counting the apiservers rather than their addresses.
+type backendsCondition struct {
+	healthy int
+	total   int
+	status  corev1.ConditionStatus
+	reason  string
+	message string
+}
+
+// NodeCondition reports the health of the backends on the Node hacox runs
+// on, as the HacoxDegraded condition and the annotations of the healthy and
+// total backends, so that the cluster sees which nodes run on fewer
+// apiservers. The Node is updated on the available backends with the
+// credentials of the discovery, at most every nodeConditionMinInterval.
+type NodeCondition struct {
+	nodeName string
+	registry *Registry
+	do       func(req *http.Request) (*http.Response, error)
+	// reported is the condition on the Node, changed when it changed.
+	reported   backendsCondition
+	changed    time.Time
+	transition time.Time
+	updated    time.Time
+	log        *slog.Logger
+}
+
+// NewNodeCondition creates a reporter of the condition of the node nodeName,
+// sending the requests with do, such as ServersConfig.Do.
+func NewNodeCondition(nodeName string, registry *Registry, do func(req *http.Request) (*http.Response, error), logger *slog.Logger) *NodeCondition {
+	return &NodeCondition{
+		nodeName: nodeName,
+		registry: registry,
+		do:       do,
+		log:      componentLogger(logger, "node condition"),
+	}
+}
+
+// Run updates the Node whenever the health of the backends changes, and
+// every nodeConditionHeartbeat, until ctx is done.
+func (n *NodeCondition) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n.update(ctx, time.Now())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (n *NodeCondition) update(ctx context.Context, now time.Time) {
+	cond := n.condition()
+	if n.updated.IsZero() || cond != n.reported {
+		if now.Sub(n.updated) < nodeConditionMinInterval {
+			return
+		}
+	} else if now.Sub(n.updated) < nodeConditionHeartbeat {
+		return
+	}
+
+	changed, transition := n.changed, n.transition
+	if n.updated.IsZero() || cond.message != n.reported.message {
+		changed = now
+	}
+	if n.updated.IsZero() || cond.status != n.reported.status {
+		transition = now
+	}
+	// retried on the next tick if the update fails
+	n.updated = now
+	if err := n.patch(ctx, cond, now, changed, transition); err != nil {
+		n.log.Error("update node condition error", "node", n.nodeName, "error", err)
+		return
+	}
+	if cond.status != n.reported.status {
+		n.log.Info("node condition updated", "node", n.nodeName, "status", cond.status, "reason", cond.reason, "message", cond.message)
+	}
+	n.reported, n.changed, n.transition = cond, changed, transition
+}
+
+// condition counts the apiservers by the groups of the backends, an
+// apiserver is healthy if any of its addresses is available.
+func (n *NodeCondition) condition() backendsCondition {
+	groups := make(map[string]bool)
+	for _, backend := range n.registry.List() {
+		if backend.Standby {
+			continue
+		}
+		group := backend.Group
+		if group == "" {
+			group = backend.Address
+		}
+		groups[group] = groups[group] || backend.Available()
+	}
+
+	var cond backendsCondition
+	var unhealthy []string
+	for group, healthy := range groups {
+		cond.total++
+		if healthy {
+			cond.healthy++
+		} else {
+			unhealthy = append(unhealthy, group)
+		}
+	}
+	sort.Strings(unhealthy)
+
+	cond.message = fmt.Sprintf("%d/%d apiservers available", cond.healthy, cond.total)
+	switch {
+	case cond.healthy == 0:
+		cond.status, cond.reason = corev1.ConditionTrue, ConditionNoBackendHealthy
+	case cond.healthy == 1:
+		cond.status, cond.reason = corev1.ConditionTrue, ConditionSingleBackend
+	case len(unhealthy) > 0:
+		cond.status, cond.reason = corev1.ConditionTrue, ConditionBackendsUnhealthy
+	default:
+		cond.status, cond.reason = corev1.ConditionFalse, ConditionBackendsHealthy
+	}
+	if len(unhealthy) > 0 {
+		cond.message += ", unavailable: " + strings.Join(unhealthy, " ")
+	}
+	return cond
+}
+
+// patch updates the condition in the status of the Node, then the
+// annotations, which the status subresource ignores.
+func (n *NodeCondition) patch(ctx context.Context, cond backendsCondition, now, changed, transition time.Time) error {
+	status, _ := json.Marshal(map[string]any{
+		"status": map[string]any{
+			"conditions": []corev1.NodeCondition{{
+				Type:               NodeConditionDegraded,
+				Status:             cond.status,
+				LastHeartbeatTime:  metav1.NewTime(now),
+				LastTransitionTime: metav1.NewTime(transition),
+				Reason:             cond.reason,
+				Message:            cond.message,
+			}},
+		},
+	})
+	path := "/api/v1/nodes/" + n.nodeName
+	if err := clusterRequest(ctx, n.registry, n.do, http.MethodPatch, path+"/status", "application/strategic-merge-patch+json", status); err != nil {
+		return fmt.Errorf("patch node status error: %v", err)
+	}
+
+	metadata, _ := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"annotations": map[string]string{
+				AnnotationHealthyBackends: strconv.Itoa(cond.healthy),
+				AnnotationTotalBackends:   strconv.Itoa(cond.total),
+				AnnotationLastChange:      changed.UTC().Format(time.RFC3339),
+			},
+		},
+	})
+	if err := clusterRequest(ctx, n.registry, n.do, http.MethodPatch, path, "application/merge-patch+json", metadata); err != nil {
+		return fmt.Errorf("patch node annotations error: %v", err)
+	}
+	return nil
+}
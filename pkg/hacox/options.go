@@ -0,0 +1,204 @@
+package hacox
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Options configures hacox. Start from DefaultOptions, the zero value of
+// some fields is not valid.
+type Options struct {
+	// ListenAddrs are the addresses the proxy listens on.
+	ListenAddrs []string
+	// Listeners are served by the proxy besides ListenAddrs, they are closed
+	// when hacox stops.
+	Listeners []net.Listener
+	// BackendPort is the port of the backends without a port.
+	BackendPort int
+
+	// KubeConfigPaths are the kubeconfig files of the built-in discovery,
+	// the first one that exists and has valid credentials is used.
+	KubeConfigPaths []string
+	// ServersConfigPath is the servers config file of the built-in
+	// discovery.
+	ServersConfigPath string
+	// RefreshInterval is the interval of the built-in discovery.
+	RefreshInterval time.Duration
+	Filter          DiscoveryFilter
+	// AddressPolicy selects the discovered addresses, nil for the default
+	// address types of any ip family.
+	AddressPolicy *AddressPolicy
+	Seeds         Seeds
+	Safeguards    Safeguards
+	// LeaseCheckInterval is the interval for checking the kube-apiserver
+	// identity leases, 0 to disable.
+	LeaseCheckInterval  time.Duration
+	LeaseStaleThreshold time.Duration
+	// StandbyTTL is the duration for keeping a removed backend as standby,
+	// 0 to disable.
+	StandbyTTL time.Duration
+
+	CheckInterval           time.Duration
+	UnHealthyCountThreshold int
+	// StandbyCheckInterval is the interval for checking the standby
+	// backends.
+	StandbyCheckInterval time.Duration
+
+	// MetricsAddr is the listen address of the metrics server, which also
+	// serves /healthz and /readyz, empty to not serve the metrics.
+	MetricsAddr string
+	// MetricsRegisterer registers the metrics of hacox, such as the registry
+	// of an embedding application.
+	MetricsRegisterer prometheus.Registerer
+	// MetricsLabels are added to all the metrics of hacox, so that several
+	// instances can register on MetricsRegisterer.
+	MetricsLabels map[string]string
+	// ProcessMetrics enables hacox_client_connections, the number of client
+	// connections of each local process, which walks every process on each
+	// scrape.
+	ProcessMetrics bool
+	// AdminAddr is the listen address of the admin API, such as
+	// DefaultAdminAddr, empty to not serve the admin API. It has no
+	// authentication, keep it on localhost.
+	AdminAddr string
+
+	// ShutdownGracePeriod is the duration for the connections to finish
+	// after hacox stops accepting connections, before they are closed.
+	ShutdownGracePeriod time.Duration
+	// LivenessTimeout is the duration after which a loop of hacox that has
+	// not made progress fails the liveness check.
+	LivenessTimeout time.Duration
+	// BindWhenReady delays listening on ListenAddrs until the health check
+	// found an available backend, so that clients fail over to another
+	// address, such as the apiservers themselves, instead of connecting to
+	// hacox while it has nowhere to proxy them to.
+	BindWhenReady bool
+	// HandoffSocket is the unix socket for handing the listeners over to a
+	// new process of hacox, which takes them over on start, empty to
+	// disable.
+	HandoffSocket string
+	// SystemdNotify enables reporting the readiness, the backend health and
+	// the liveness to systemd, if hacox is run by systemd with
+	// NOTIFY_SOCKET.
+	SystemdNotify bool
+
+	// NodeName is the name of the Node hacox runs on.
+	NodeName string
+	// Events enables posting Kubernetes Events about the Node when the
+	// backends change, with the credentials of the built-in discovery.
+	Events bool
+	// NodeCondition enables reporting the health of the backends as the
+	// HacoxDegraded condition of the Node, with the credentials of the
+	// built-in discovery.
+	NodeCondition bool
+
+	// AccessLog is the file the connections are written to, "-" for stdout,
+	// empty to disable.
+	AccessLog string
+	// AccessLogMaxSize is the size in megabytes at which the access log file
+	// is rotated, keeping AccessLogMaxBackups rotated files.
+	AccessLogMaxSize    int
+	AccessLogMaxBackups int
+	// AccessLogSampleRate is the fraction of the connections written to the
+	// access log, the connections that fail before reaching a backend are
+	// always written.
+	AccessLogSampleRate float64
+
+	// Logger is the logger of this instance of hacox, nil for the default
+	// logger of slog.
+	Logger *slog.Logger
+	// LogRateBurst is the number of records with the same level, message and
+	// backend, server, node, pod or address logged in every LogRateInterval,
+	// 0 to not limit the rate.
+	LogRateBurst    int
+	LogRateInterval time.Duration
+
+	// Discovery replaces the built-in discovery from the servers config and
+	// the Kubernetes cluster, in which case the options of the built-in
+	// discovery are ignored.
+	Discovery Discovery
+	// Prober replaces the built-in /readyz health check.
+	Prober Prober
+	// Balancer replaces the built-in balancer, which selects an apiserver by
+	// weight first, then prefers its address in the ip family of the client.
+	Balancer Balancer
+}
+
+func DefaultOptions() Options {
+	return Options{
+		ListenAddrs:             []string{"127.0.0.1:5443", "[::1]:5443"},
+		BackendPort:             6443,
+		ServersConfigPath:       "servers.yaml",
+		RefreshInterval:         2 * time.Minute,
+		Filter:                  DefaultDiscoveryFilter(),
+		Safeguards:              DefaultSafeguards(),
+		LeaseStaleThreshold:     time.Minute,
+		StandbyTTL:              time.Hour,
+		CheckInterval:           2 * time.Second,
+		UnHealthyCountThreshold: 3,
+		StandbyCheckInterval:    30 * time.Second,
+		MetricsAddr:             ":5444",
+		ShutdownGracePeriod:     20 * time.Second,
+		LivenessTimeout:         2 * time.Minute,
+		AccessLogMaxSize:        100,
+		AccessLogMaxBackups:     3,
+		AccessLogSampleRate:     1,
+		LogRateBurst:            5,
+		LogRateInterval:         time.Minute,
+	}
+}
+
+func (o *Options) Validate() error {
+	if len(o.ListenAddrs) == 0 && len(o.Listeners) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	if o.BackendPort <= 0 || o.BackendPort > 65535 {
+		return fmt.Errorf("invalid backend port %d", o.BackendPort)
+	}
+	if o.CheckInterval <= 0 {
+		return fmt.Errorf("the check interval must be positive")
+	}
+	if o.LivenessTimeout <= 0 {
+		return fmt.Errorf("the liveness timeout must be positive")
+	}
+	if o.ShutdownGracePeriod < 0 {
+		return fmt.Errorf("the shutdown grace period must not be negative")
+	}
+	if o.UnHealthyCountThreshold < 1 {
+		return fmt.Errorf("the unhealthy count threshold must be at least 1")
+	}
+	if o.LogRateBurst > 0 && o.LogRateInterval <= 0 {
+		return fmt.Errorf("the log rate interval must be positive")
+	}
+	if o.Events && o.NodeName == "" {
+		return fmt.Errorf("no node name for the events")
+	}
+	if o.NodeCondition && o.NodeName == "" {
+		return fmt.Errorf("no node name for the node condition")
+	}
+	if o.AccessLog != "" {
+		if o.AccessLogMaxSize <= 0 {
+			return fmt.Errorf("the access log max size must be positive")
+		}
+		if o.AccessLogMaxBackups < 0 {
+			return fmt.Errorf("the access log max backups must not be negative")
+		}
+		if o.AccessLogSampleRate < 0 || o.AccessLogSampleRate > 1 {
+			return fmt.Errorf("the access log sample rate must be between 0 and 1")
+		}
+	}
+	if o.Discovery != nil {
+		return nil
+	}
+	if o.ServersConfigPath == "" {
+		return fmt.Errorf("no servers config path")
+	}
+	if o.RefreshInterval <= 0 {
+		return fmt.Errorf("the refresh interval must be positive")
+	}
+	return o.Safeguards.Validate()
+}
@@ -0,0 +1,193 @@
+package hacox
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var podUIDPattern = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// socketKey is a tcp socket by its local and remote address.
+type socketKey struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+// lookupProcesses sets the local processes of the clients. The socket of a
+// client is found in /proc/net/tcp and /proc/net/tcp6 by its addresses, then
+// its process by walking the file descriptors of every process, which needs
+// the host pid namespace and, for the processes of other users,
+// CAP_SYS_PTRACE.
+func lookupProcesses(conns []Connection, log *slog.Logger) {
+	sockets := make(map[socketKey][]int)
+	for i, conn := range conns {
+		client, err1 := netip.ParseAddrPort(conn.Client)
+		local, err2 := netip.ParseAddrPort(conn.Local)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		// the socket of the client is the reverse of the accepted one
+		key := socketKey{local: unmapAddrPort(client), remote: unmapAddrPort(local)}
+		sockets[key] = append(sockets[key], i)
+	}
+	if len(sockets) == 0 {
+		return
+	}
+
+	inodes := make(map[string][]int)
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		if err := readSocketInodes(path, sockets, inodes); err != nil {
+			log.Warn("read sockets error", "path", path, "error", err)
+		}
+	}
+	if len(inodes) == 0 {
+		return
+	}
+
+	pids, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return
+	}
+	for _, dir := range pids {
+		fds, err := os.ReadDir(filepath.Join(dir, "fd"))
+		if err != nil {
+			continue
+		}
+
+		var process *Process
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(dir, "fd", fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode := strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")
+			indexes, ok := inodes[inode]
+			if !ok {
+				continue
+			}
+
+			if process == nil {
+				process = readProcess(dir)
+			}
+			for _, i := range indexes {
+				conns[i].Process = process
+			}
+			delete(inodes, inode)
+		}
+		if len(inodes) == 0 {
+			return
+		}
+	}
+}
+
+// readSocketInodes adds the inodes of the sockets in the /proc/net/tcp file
+// at path to inodes.
+func readSocketInodes(path string, sockets map[socketKey][]int, inodes map[string][]int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// skip the header
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, err := parseProcNetAddr(fields[1])
+		if err != nil {
+			continue
+		}
+		remote, err := parseProcNetAddr(fields[2])
+		if err != nil {
+			continue
+		}
+		indexes, ok := sockets[socketKey{local: local, remote: remote}]
+		// inode 0 is a socket that is closing
+		if !ok || fields[9] == "0" {
+			continue
+		}
+		inodes[fields[9]] = append(inodes[fields[9]], indexes...)
+	}
+	return scanner.Err()
+}
+
+// parseProcNetAddr parses an address of /proc/net/tcp, such as
+// 0100007F:1538, whose ip is in 32-bit words of the host byte order.
+func parseProcNetAddr(s string) (netip.AddrPort, error) {
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %s", s)
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %s", s)
+	}
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(b[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %s", s)
+	}
+	return netip.AddrPortFrom(addr.Unmap(), uint16(p)), nil
+}
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap().WithZone(""), ap.Port())
+}
+
+// readProcess reads the process of the /proc/<pid> directory.
+func readProcess(dir string) *Process {
+	pid, _ := strconv.Atoi(filepath.Base(dir))
+	process := &Process{PID: pid}
+
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		process.Command = strings.TrimSpace(string(comm))
+	}
+	if cgroup, err := os.ReadFile(filepath.Join(dir, "cgroup")); err == nil {
+		process.Cgroup = parseCgroup(string(cgroup))
+		if m := podUIDPattern.FindStringSubmatch(process.Cgroup); m != nil {
+			process.PodUID = strings.ReplaceAll(m[1], "_", "-")
+		}
+	}
+	return process
+}
+
+// parseCgroup returns the cgroup path of /proc/<pid>/cgroup, preferring the
+// path of a pod, then the path of the unified hierarchy.
+func parseCgroup(s string) string {
+	var unified, first string
+	for _, line := range strings.Split(strings.TrimSpace(s), "\n") {
+		// hierarchy-ID:controller-list:cgroup-path
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		switch {
+		case strings.Contains(parts[2], "kubepods"):
+			return parts[2]
+		case parts[0] == "0":
+			unified = parts[2]
+		case first == "":
+			first = parts[2]
+		}
+	}
+	if unified != "" {
+		return unified
+	}
+	return first
+}
@@ -0,0 +1,141 @@
+package hacox
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// littleEndian reports whether the addresses of /proc/net/tcp in the tests,
+// which are in the host byte order, are in the byte order of this host.
+func littleEndian() bool {
+	return binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+}
+
+func TestParseProcNetAddr(t *testing.T) {
+	if !littleEndian() {
+		t.Skip("the addresses are in little endian")
+	}
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "0100007F:1538", want: "127.0.0.1:5432"},
+		{s: "0A00000A:01BB", want: "10.0.0.10:443"},
+		{s: "00000000000000000000000001000000:1538", want: "[::1]:5432"},
+		{s: "0000000000000000FFFF00000100007F:1538", want: "127.0.0.1:5432"},
+		{s: "000080FE00000000FF0000000100000A:0050", want: "[fe80::ff:a00:1]:80"},
+		{s: "0100007F", wantErr: true},
+		{s: "0100007:1538", wantErr: true},
+		{s: "0100007G:1538", wantErr: true},
+		{s: "01007F:1538", wantErr: true},
+		{s: "0100007F:10000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := parseProcNetAddr(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("parseProcNetAddr(%s) = %s, want %s", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadSocketInodes(t *testing.T) {
+	if !littleEndian() {
+		t.Skip("the addresses are in little endian")
+	}
+	data := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1538 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1000 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:D431 0100007F:1538 01 00000000:00000000 00:00000000 00000000  1000        0 2000 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:D432 0100007F:1538 06 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 20 4 30 10 -1
+   3: 0100007F:D433 0100007F:1538 01 00000000:00000000 00:00000000 00000000  1000        0 3000 1 0000000000000000 20 4 30 10 -1
+   4: invalid
+`
+	path := filepath.Join(t.TempDir(), "tcp")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := netip.MustParseAddrPort("127.0.0.1:5432")
+	sockets := map[socketKey][]int{
+		{local: netip.MustParseAddrPort("127.0.0.1:54321"), remote: server}: {0, 2},
+		// closing
+		{local: netip.MustParseAddrPort("127.0.0.1:54322"), remote: server}: {1},
+		// not in the file
+		{local: netip.MustParseAddrPort("127.0.0.1:54324"), remote: server}: {3},
+	}
+	inodes := make(map[string][]int)
+	if err := readSocketInodes(path, sockets, inodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(inodes) != 1 || !slices.Equal(inodes["2000"], []int{0, 2}) {
+		t.Errorf("inodes = %v, want map[2000:[0 2]]", inodes)
+	}
+}
+
+func TestParseCgroup(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{
+			name: "unified",
+			s:    "0::/system.slice/kubelet.service\n",
+			want: "/system.slice/kubelet.service",
+		},
+		{
+			name: "pod",
+			s:    "12:cpu,cpuacct:/kubepods/burstable/pod1234\n0::/\n",
+			want: "/kubepods/burstable/pod1234",
+		},
+		{
+			name: "first hierarchy",
+			s:    "12:memory:/user.slice\n11:cpu:/system.slice\n",
+			want: "/user.slice",
+		},
+		{
+			name: "invalid lines",
+			s:    "invalid\n\n3:pids:/init.scope\n",
+			want: "/init.scope",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseCgroup(tt.s); got != tt.want {
+				t.Errorf("parseCgroup = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodUIDPattern(t *testing.T) {
+	tests := []struct {
+		cgroup string
+		want   string
+	}{
+		{"/kubepods/burstable/pod0c2a5e4c-52a8-4b6c-9a7e-5f5a1e3c2b1d/abc", "0c2a5e4c-52a8-4b6c-9a7e-5f5a1e3c2b1d"},
+		{"/kubepods.slice/kubepods-pod0c2a5e4c_52a8_4b6c_9a7e_5f5a1e3c2b1d.slice/cri-containerd-abc.scope", "0c2a5e4c_52a8_4b6c_9a7e_5f5a1e3c2b1d"},
+		{"/system.slice/kubelet.service", ""},
+	}
+
+	for _, tt := range tests {
+		var got string
+		if m := podUIDPattern.FindStringSubmatch(tt.cgroup); m != nil {
+			got = m[1]
+		}
+		if got != tt.want {
+			t.Errorf("pod uid of %s = %q, want %q", tt.cgroup, got, tt.want)
+		}
+	}
+}
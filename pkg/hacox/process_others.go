@@ -0,0 +1,8 @@
+//go:build !linux
+
+package hacox
+
+import "log/slog"
+
+func lookupProcesses(conns []Connection, log *slog.Logger) {
+}
@@ -2,100 +2,105 @@ package hacox
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"maps"
-	"math/rand"
 	"net"
-	"slices"
+	"os"
 	"sync"
 	"time"
 )
 
 type Proxy struct {
 	listenAddrs []string
-	backends    []string
+	listeners   []net.Listener
+	inherited   map[string]net.Listener
+	bound       map[string]net.Listener
+	registry    *Registry
+	balancer    Balancer
 	conns       map[string]map[net.Conn]struct{}
 	connsCount  map[string]int
+	clients     map[*clientConn]struct{}
+	// closing is set once drain closes the remaining connections, the
+	// connections registered later are closed right away.
+	closing     bool
 	lock        sync.RWMutex
 	dialer      *net.Dialer
+	active      sync.WaitGroup
+	gracePeriod time.Duration
+	bindWhen    func() bool
+	accessLog   *AccessLog
+	heartbeats  map[string]*heartbeat
+	dialFuncs   []LatencyFunc
+	log         *slog.Logger
 }
 
-func NewProxy(listenAddrs []string, backends ...string) *Proxy {
-	return &Proxy{
+// NewProxy creates a proxy to the backends in the registry, serving the
+// listeners besides listening on listenAddrs. It logs with logger, nil for
+// the default logger of slog.
+func NewProxy(registry *Registry, balancer Balancer, logger *slog.Logger, listenAddrs []string, listeners ...net.Listener) *Proxy {
+	p := &Proxy{
 		listenAddrs: listenAddrs,
-		backends:    backends,
+		listeners:   listeners,
+		registry:    registry,
+		balancer:    balancer,
 		conns:       make(map[string]map[net.Conn]struct{}),
 		connsCount:  make(map[string]int),
+		clients:     make(map[*clientConn]struct{}),
 		dialer: &net.Dialer{
 			Timeout:   10 * time.Second,
 			KeepAlive: 5 * time.Second,
 		},
+		log: componentLogger(logger, "proxy"),
 	}
+	registry.Subscribe(p.onEvent)
+	return p
 }
 
 func (p *Proxy) GetBackendsClientsCount() map[string]int {
 	p.lock.RLock()
-	defer p.lock.RUnlock()
-
 	counts := maps.Clone(p.connsCount)
-	for _, backend := range p.backends {
-		if _, ok := counts[backend]; !ok {
-			counts[backend] = 0
+	p.lock.RUnlock()
+
+	for _, backend := range p.registry.List() {
+		if _, ok := counts[backend.Address]; !ok && backend.Available() {
+			counts[backend.Address] = 0
 		}
 	}
 
 	return counts
 }
 
-func (p *Proxy) UpdateBackends(backends []string) {
-	var oldBackends []string
-
-	p.lock.Lock()
-	if slices.Equal(p.backends, backends) {
-		p.lock.Unlock()
+// onEvent closes the connections of a backend that is removed, becomes
+// unhealthy or is disabled. The connections of a draining backend are kept.
+func (p *Proxy) onEvent(event BackendEvent) {
+	var reason string
+	switch {
+	case event.Type == BackendRemoved:
+		reason = reasonBackendRemoved
+	case event.Type == BackendUpdated && event.Old.Healthy && !event.Backend.Healthy:
+		reason = reasonBackendUnhealthy
+	case event.Type == BackendUpdated && !event.Old.Disabled && event.Backend.Disabled:
+		reason = reasonBackendDisabled
+	default:
 		return
 	}
-	oldBackends = slices.Clone(p.backends)
-	p.backends = slices.Clone(backends)
-	p.lock.Unlock()
-
-	var removed []string
-
-	for _, it := range oldBackends {
-		if !slices.Contains(backends, it) {
-			removed = append(removed, it)
-		}
-	}
-
-	for _, it := range removed {
-		p.delBackend(it)
-	}
-}
 
-func (p *Proxy) OnNotify(backend string, healthy bool) {
-	if healthy {
-		p.addBackend(backend)
-	} else {
-		p.delBackend(backend)
-	}
+	p.closeConns(event.Backend.Address, reason)
 }
 
-func (p *Proxy) addBackend(backend string) {
+func (p *Proxy) closeConns(backend, reason string) {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
-	if slices.Contains(p.backends, backend) {
-		return
+	for c := range p.clients {
+		if c.backend == backend {
+			c.close(reason)
+		}
 	}
 
-	p.backends = append(p.backends, backend)
-}
-
-func (p *Proxy) delBackend(backend string) {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-
 	if conns, ok := p.conns[backend]; ok {
 		for conn := range conns {
 			conn.Close()
@@ -104,65 +109,331 @@ func (p *Proxy) delBackend(backend string) {
 
 	delete(p.conns, backend)
 	delete(p.connsCount, backend)
+}
 
-	if idx := slices.Index(p.backends, backend); idx != -1 {
-		p.backends = slices.Delete(p.backends, idx, idx+1)
+// DrainOnStop enables waiting up to gracePeriod for the connections to
+// finish after the proxy stops accepting connections, before closing them.
+func (p *Proxy) DrainOnStop(gracePeriod time.Duration) {
+	p.gracePeriod = gracePeriod
+}
+
+// LogAccess enables writing the connections to the access log.
+func (p *Proxy) LogAccess(accessLog *AccessLog) {
+	p.accessLog = accessLog
+}
+
+// Inherit sets the listeners taken over from another process, keyed by their
+// listen address. They are used instead of listening on the same listen
+// addresses, and the others are closed.
+func (p *Proxy) Inherit(listeners map[string]net.Listener) {
+	p.inherited = listeners
+}
+
+// ListenerFiles returns the listen addresses of the listeners being served
+// and duplicates of their files, to hand them over to another process.
+func (p *Proxy) ListenerFiles() ([]string, []*os.File, error) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	var (
+		addrs []string
+		files []*os.File
+	)
+	for addr, listener := range p.bound {
+		filer, ok := listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			p.log.Warn("listener can not be handed over", "listener", addr)
+			continue
+		}
+		f, err := filer.File()
+		if err != nil {
+			for _, it := range files {
+				it.Close()
+			}
+			return nil, nil, fmt.Errorf("get file of listener %s error: %v", addr, err)
+		}
+		addrs = append(addrs, addr)
+		files = append(files, f)
 	}
+	return addrs, files, nil
 }
 
+// Serving reports whether the proxy is accepting connections.
+func (p *Proxy) Serving() bool {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.bound != nil
+}
+
+// Start serves the listeners until ctx is done, then stops accepting
+// connections and drains the connections.
 func (p *Proxy) Start(ctx context.Context) error {
-	lc := net.ListenConfig{
-		KeepAlive: 5 * time.Second,
+	var (
+		bound     = make(map[string]net.Listener)
+		accepting sync.WaitGroup
+	)
+	defer func() {
+		p.lock.Lock()
+		p.bound = nil
+		p.heartbeats = nil
+		p.lock.Unlock()
+		for _, listener := range bound {
+			listener.Close()
+		}
+		accepting.Wait()
+	}()
+	serve := func(addr string, listener net.Listener) {
+		bound[addr] = listener
+		hb := &heartbeat{}
+		hb.beat()
+		p.lock.Lock()
+		if p.heartbeats == nil {
+			p.heartbeats = make(map[string]*heartbeat)
+		}
+		p.heartbeats[addr] = hb
+		p.lock.Unlock()
+
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			p.accept(ctx, listener, hb)
+		}()
 	}
 
+	for _, listener := range p.listeners {
+		serve(listener.Addr().String(), listener)
+	}
+	var listenAddrs []string
 	for _, listenAddr := range p.listenAddrs {
+		if listener, ok := p.inherited[listenAddr]; ok {
+			p.log.Info("serve inherited listener", "listener", listenAddr)
+			serve(listenAddr, listener)
+		} else {
+			listenAddrs = append(listenAddrs, listenAddr)
+		}
+	}
+	for addr, listener := range p.inherited {
+		if _, ok := bound[addr]; !ok {
+			p.log.Info("close inherited listener, which is not a listen address", "listener", addr)
+			listener.Close()
+		}
+	}
+
+	if len(listenAddrs) > 0 && p.bindWhen != nil && !p.waitBind(ctx) {
+		return nil
+	}
+	lc := net.ListenConfig{
+		KeepAlive: 5 * time.Second,
+	}
+	for _, listenAddr := range listenAddrs {
 		listener, err := lc.Listen(context.Background(), "tcp", listenAddr)
 		if err != nil {
 			return err
 		}
-		defer listener.Close()
-
-		go func(addr string, listener net.Listener, ctx context.Context) {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					conn, err := listener.Accept()
-					if err != nil {
-						log.Printf("accept connection from %s error: %v", addr, err)
-						continue
-					}
-					go p.connect(conn)
-				}
-			}
-		}(listenAddr, listener, ctx)
+		serve(listenAddr, listener)
 	}
 
+	p.lock.Lock()
+	p.bound = maps.Clone(bound)
+	p.lock.Unlock()
+
 	<-ctx.Done()
+	p.log.Info("stop accepting connections")
+	p.lock.Lock()
+	p.bound = nil
+	p.heartbeats = nil
+	p.lock.Unlock()
+	for _, listener := range bound {
+		listener.Close()
+	}
+	accepting.Wait()
+
+	p.drain()
 	return nil
 }
 
-func (p *Proxy) getBackend() string {
+// NotifyDials registers the dialFuncs to receive the result of every dial to
+// a backend.
+func (p *Proxy) NotifyDials(dialFuncs ...LatencyFunc) {
+	p.dialFuncs = append(p.dialFuncs, dialFuncs...)
+}
+
+// BindWhen delays listening on the listen addresses until ready reports
+// true. The listeners passed to NewProxy and the inherited ones are served
+// right away.
+func (p *Proxy) BindWhen(ready func() bool) {
+	p.bindWhen = ready
+}
+
+// waitBind waits until the listen addresses may be bound, and reports false
+// if ctx is done first.
+func (p *Proxy) waitBind(ctx context.Context) bool {
+	if p.bindWhen() {
+		return true
+	}
+	p.log.Info("wait for an available backend before listening")
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if p.bindWhen() {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// LastHeartbeat returns the oldest heartbeat of the accept loops, which beat
+// whenever they accept a connection and at least every heartbeatInterval.
+// It returns the current time while the proxy is not accepting connections.
+func (p *Proxy) LastHeartbeat() time.Time {
 	p.lock.RLock()
 	defer p.lock.RUnlock()
 
-	if len(p.backends) == 0 {
-		return ""
+	last := time.Now()
+	for _, hb := range p.heartbeats {
+		if t := hb.Last(); t.Before(last) {
+			last = t
+		}
 	}
+	return last
+}
+
+// accept accepts the connections of the listener until it is closed,
+// backing off on temporary errors such as running out of file descriptors.
+func (p *Proxy) accept(ctx context.Context, listener net.Listener, hb *heartbeat) {
+	addr := listener.Addr().String()
+	// the deadline wakes up the loop to beat while there is no connection
+	deadliner, _ := listener.(interface{ SetDeadline(time.Time) error })
+
+	var delay time.Duration
+	for {
+		if deadliner != nil {
+			deadliner.SetDeadline(time.Now().Add(heartbeatInterval))
+		}
+		conn, err := listener.Accept()
+		hb.beat()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, time.Second)
+			}
+			p.log.Error("accept connection error", "listener", addr, "retry", delay, "error", err)
 
-	return p.backends[rand.Intn(len(p.backends))]
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		delay = 0
+
+		p.active.Add(1)
+		go func() {
+			defer p.active.Done()
+			p.connect(conn)
+		}()
+	}
 }
 
-func (p *Proxy) addConn(backend string, conn net.Conn) {
+// drain waits up to the grace period for the connections to finish, then
+// closes the remaining ones.
+func (p *Proxy) drain() {
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+
+	if p.gracePeriod > 0 {
+		p.log.Info("draining connections", "gracePeriod", p.gracePeriod)
+		timer := time.NewTimer(p.gracePeriod)
+		defer timer.Stop()
+
+		select {
+		case <-done:
+			p.log.Info("all connections drained")
+			return
+		case <-timer.C:
+		}
+	}
+
+	p.lock.Lock()
+	p.closing = true
+	backends := make([]string, 0, len(p.conns))
+	for backend := range p.conns {
+		backends = append(backends, backend)
+	}
+	p.lock.Unlock()
+
+	for _, backend := range backends {
+		p.log.Info("close the remaining connections", "backend", backend)
+		p.closeConns(backend, reasonShutdown)
+	}
+	<-done
+}
+
+// getBackend selects an available backend for a client connected through the
+// local address, preferring the backends whose apiserver lease is not stale.
+// A healthy standby backend is only selected when no backend is available.
+func (p *Proxy) getBackend(local net.Addr) string {
+	var backends, fresh, standby []Backend
+	for _, backend := range p.registry.List() {
+		switch {
+		case backend.Available():
+			backends = append(backends, backend)
+			if !backend.Stale {
+				fresh = append(fresh, backend)
+			}
+		case backend.Standby && backend.Healthy:
+			standby = append(standby, backend)
+		}
+	}
+
+	if len(backends) == 0 {
+		if len(standby) == 0 {
+			return ""
+		}
+		backend := p.balancer.Pick(standby, local).Address
+		p.log.Warn("no backend available, use standby", "backend", backend)
+		return backend
+	}
+	if len(fresh) > 0 {
+		backends = fresh
+	}
+
+	return p.balancer.Pick(backends, local).Address
+}
+
+// addConn registers a connection to be closed with the backend, and reports
+// false if the proxy is closing its connections.
+func (p *Proxy) addConn(backend string, conn net.Conn) bool {
 	p.lock.Lock()
 	defer p.lock.Unlock()
 
+	if p.closing {
+		return false
+	}
 	if _, ok := p.conns[backend]; !ok {
 		p.conns[backend] = make(map[net.Conn]struct{})
 	}
 
 	p.conns[backend][conn] = struct{}{}
+	return true
 }
 
 func (p *Proxy) incCount(backend string) {
@@ -191,27 +462,66 @@ func (p *Proxy) delConn(backend string, conn net.Conn) {
 }
 
 func (p *Proxy) connect(conn net.Conn) {
-	backend := p.getBackend()
+	c := &clientConn{
+		client:  conn.RemoteAddr(),
+		local:   conn.LocalAddr(),
+		started: time.Now(),
+	}
+	sampled := p.accessLog != nil && p.accessLog.sample()
+
+	backend := p.getBackend(conn.LocalAddr())
 	if backend == "" {
-		log.Println("no backend available")
+		p.log.Error("no backend available", "client", c.client.String())
 		conn.Close()
+		p.logAccess(c, reasonNoBackend, true)
 		return
 	}
+	c.backend = backend
 
 	defer p.delConn(backend, conn)
 
+	start := time.Now()
 	backConn, err := p.dialer.Dial("tcp", backend)
+	for _, f := range p.dialFuncs {
+		if f != nil {
+			f(backend, time.Since(start), err)
+		}
+	}
 	if err != nil {
+		p.log.Error("dial backend error", "backend", backend, "error", err)
+		p.logAccess(c, fmt.Sprintf("dial error: %v", err), true)
 		return
 	}
+	c.upstream = backConn.LocalAddr()
 
 	defer p.delConn(backend, backConn)
-	p.addConn(backend, backConn)
-
-	p.addConn(backend, conn)
+	if !p.addConn(backend, backConn) || !p.addConn(backend, conn) {
+		p.logAccess(c, reasonShutdown, sampled)
+		return
+	}
 	p.incCount(backend)
 	defer p.decCount(backend)
 
-	go io.Copy(backConn, conn)
-	io.Copy(conn, backConn)
+	p.addClient(c)
+	defer p.delClient(c)
+
+	go func() {
+		io.Copy(countingWriter{backConn, &c.bytesIn}, conn)
+		c.close(reasonClientClosed)
+		// let the backend finish and close the connection
+		if tc, ok := backConn.(*net.TCPConn); ok {
+			tc.CloseWrite()
+		}
+	}()
+	io.Copy(countingWriter{conn, &c.bytesOut}, backConn)
+	p.logAccess(c, reasonBackendClosed, sampled)
+}
+
+// logAccess writes the connection to the access log, with reason unless it
+// was closed for another reason.
+func (p *Proxy) logAccess(c *clientConn, reason string, sampled bool) {
+	c.close(reason)
+	if p.accessLog != nil && sampled {
+		p.accessLog.Log(c.accessLogEntry())
+	}
 }
@@ -0,0 +1,276 @@
+package hacox
+
+import (
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Backend is the state of a backend in the registry.
+type Backend struct {
+	Address string `json:"address"`
+	// Source is how the backend was discovered, see ServerEntry.Source.
+	Source string `json:"source,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Weight int    `json:"weight"`
+	// Healthy is the result of the health checks. A new backend is healthy
+	// until it fails the health checks, a new standby backend is unhealthy
+	// until it passes one.
+	Healthy bool `json:"healthy"`
+	// Stale reports that the apiserver lease of the backend is stale.
+	Stale bool `json:"stale"`
+	// Standby backends were removed by discovery recently.
+	Standby bool `json:"standby"`
+	// Draining backends keep their connections but get no new ones.
+	Draining bool `json:"draining"`
+	// Disabled backends get no connections, their connections are closed.
+	Disabled bool `json:"disabled"`
+}
+
+// Available reports whether the backend may get new connections.
+func (b Backend) Available() bool {
+	return b.Healthy && !b.Standby && !b.Draining && !b.Disabled
+}
+
+type BackendEventType string
+
+const (
+	BackendAdded   BackendEventType = "added"
+	BackendUpdated BackendEventType = "updated"
+	BackendRemoved BackendEventType = "removed"
+)
+
+// BackendEvent is a change of a backend in the registry. Old is the state
+// before the change and is empty for an added backend, Backend is the state
+// after the change and is the last state for a removed backend.
+type BackendEvent struct {
+	Type    BackendEventType `json:"type"`
+	Backend Backend          `json:"backend"`
+	Old     Backend          `json:"old"`
+}
+
+type BackendEventFunc func(event BackendEvent)
+
+// Registry holds the state of every backend. The discovery, the health check
+// and the operator update it, the proxy and the metrics read it and subscribe
+// to its changes.
+type Registry struct {
+	lock        sync.RWMutex
+	publishing  sync.Mutex
+	backends    map[string]*Backend
+	subscribers []BackendEventFunc
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		backends: make(map[string]*Backend),
+	}
+}
+
+// Subscribe registers f to be called with every change of the registry. The
+// events are delivered synchronously and in order, after the registry is
+// unlocked. f may read the registry but must not update it.
+func (r *Registry) Subscribe(f BackendEventFunc) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.subscribers = append(r.subscribers, f)
+}
+
+// Get returns the state of the backend.
+func (r *Registry) Get(address string) (Backend, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	b, ok := r.backends[address]
+	if !ok {
+		return Backend{}, false
+	}
+	return *b, true
+}
+
+// List returns the state of every backend sorted by address.
+func (r *Registry) List() []Backend {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	list := make([]Backend, 0, len(r.backends))
+	for _, b := range r.backends {
+		list = append(list, *b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+// GetBackendsHealth returns the health of the backends that are not standby.
+func (r *Registry) GetBackendsHealth() map[string]bool {
+	return r.health(false)
+}
+
+// GetStandbyHealth returns the health of the standby backends.
+func (r *Registry) GetStandbyHealth() map[string]bool {
+	return r.health(true)
+}
+
+func (r *Registry) health(standby bool) map[string]bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	health := make(map[string]bool)
+	for address, b := range r.backends {
+		if b.Standby == standby {
+			health[address] = b.Healthy
+		}
+	}
+	return health
+}
+
+// UpdateBackends sets the discovered backends. New backends are added as
+// healthy, standby backends that are discovered again become active, and
+// the active backends that are not discovered any more are removed.
+func (r *Registry) UpdateBackends(backends []string) {
+	r.update(func(events []BackendEvent) []BackendEvent {
+		for address, b := range r.backends {
+			if !b.Standby && !slices.Contains(backends, address) {
+				events = r.remove(events, address)
+			}
+		}
+		for _, address := range backends {
+			b, ok := r.backends[address]
+			switch {
+			case !ok:
+				events = r.add(events, Backend{Address: address, Weight: 1, Healthy: true})
+			case b.Standby:
+				events = r.set(events, address, func(b *Backend) {
+					b.Standby = false
+					b.Healthy = true
+				})
+			}
+		}
+		return events
+	})
+}
+
+// UpdateStandby sets the standby backends. Standby backends that are not in
+// backends are removed, and active backends are left as they are.
+func (r *Registry) UpdateStandby(backends []string) {
+	r.update(func(events []BackendEvent) []BackendEvent {
+		for address, b := range r.backends {
+			if b.Standby && !slices.Contains(backends, address) {
+				events = r.remove(events, address)
+			}
+		}
+		for _, address := range backends {
+			if _, ok := r.backends[address]; !ok {
+				events = r.add(events, Backend{Address: address, Weight: 1, Standby: true})
+			}
+		}
+		return events
+	})
+}
+
+// UpdateInfos sets the metadata of the backends.
+func (r *Registry) UpdateInfos(infos map[string]BackendInfo) {
+	r.update(func(events []BackendEvent) []BackendEvent {
+		for address, info := range infos {
+			events = r.set(events, address, func(b *Backend) {
+				b.Source = info.Source
+				b.Group = info.Group
+				b.Weight = max(info.Weight, 1)
+			})
+		}
+		return events
+	})
+}
+
+// SetHealthy sets the health of the backend.
+func (r *Registry) SetHealthy(address string, healthy bool) {
+	r.update(func(events []BackendEvent) []BackendEvent {
+		return r.set(events, address, func(b *Backend) { b.Healthy = healthy })
+	})
+}
+
+// OnStale sets whether the apiserver lease of the backend is stale.
+func (r *Registry) OnStale(address string, stale bool) {
+	r.update(func(events []BackendEvent) []BackendEvent {
+		return r.set(events, address, func(b *Backend) { b.Stale = stale })
+	})
+}
+
+// SetDraining sets whether the backend is draining, and reports whether the
+// backend is known.
+func (r *Registry) SetDraining(address string, draining bool) bool {
+	var ok bool
+	r.update(func(events []BackendEvent) []BackendEvent {
+		_, ok = r.backends[address]
+		return r.set(events, address, func(b *Backend) { b.Draining = draining })
+	})
+	return ok
+}
+
+// SetDisabled sets whether the backend is disabled, and reports whether the
+// backend is known.
+func (r *Registry) SetDisabled(address string, disabled bool) bool {
+	var ok bool
+	r.update(func(events []BackendEvent) []BackendEvent {
+		_, ok = r.backends[address]
+		return r.set(events, address, func(b *Backend) { b.Disabled = disabled })
+	})
+	return ok
+}
+
+// Enable clears the draining and disabled state of the backend, and reports
+// whether the backend is known.
+func (r *Registry) Enable(address string) bool {
+	var ok bool
+	r.update(func(events []BackendEvent) []BackendEvent {
+		_, ok = r.backends[address]
+		return r.set(events, address, func(b *Backend) {
+			b.Draining = false
+			b.Disabled = false
+		})
+	})
+	return ok
+}
+
+// update applies f under the lock and publishes the events it returns.
+func (r *Registry) update(f func(events []BackendEvent) []BackendEvent) {
+	r.publishing.Lock()
+	defer r.publishing.Unlock()
+
+	r.lock.Lock()
+	events := f(nil)
+	subscribers := slices.Clone(r.subscribers)
+	r.lock.Unlock()
+
+	for _, event := range events {
+		for _, s := range subscribers {
+			s(event)
+		}
+	}
+}
+
+func (r *Registry) add(events []BackendEvent, b Backend) []BackendEvent {
+	r.backends[b.Address] = &b
+	return append(events, BackendEvent{Type: BackendAdded, Backend: b})
+}
+
+func (r *Registry) remove(events []BackendEvent, address string) []BackendEvent {
+	b := r.backends[address]
+	delete(r.backends, address)
+	return append(events, BackendEvent{Type: BackendRemoved, Backend: *b, Old: *b})
+}
+
+func (r *Registry) set(events []BackendEvent, address string, f func(b *Backend)) []BackendEvent {
+	b, ok := r.backends[address]
+	if !ok {
+		return events
+	}
+
+	old := *b
+	f(b)
+	if *b == old {
+		return events
+	}
+	return append(events, BackendEvent{Type: BackendUpdated, Backend: *b, Old: old})
+}
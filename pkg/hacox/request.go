@@ -0,0 +1,81 @@
+package hacox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// statusError is an error response of the apiserver.
+type statusError struct {
+	code int
+	body string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.code, http.StatusText(e.code), e.body)
+}
+
+func isNotFound(err error) bool {
+	se, ok := err.(*statusError)
+	return ok && se.code == http.StatusNotFound
+}
+
+// clusterRequest sends a request to the backends until one of them answers,
+// the available ones first in random order, since the others may still
+// answer when no backend is available. An error response of an apiserver is
+// returned as a *statusError without trying the other backends, unless it
+// is a server error.
+func clusterRequest(ctx context.Context, registry *Registry, do func(req *http.Request) (*http.Response, error), method, path, contentType string, body []byte) error {
+	var available, others []string
+	for _, backend := range registry.List() {
+		if backend.Available() {
+			available = append(available, backend.Address)
+		} else if !backend.Disabled {
+			others = append(others, backend.Address)
+		}
+	}
+	rand.Shuffle(len(available), func(i, j int) {
+		available[i], available[j] = available[j], available[i]
+	})
+	backends := append(available, others...)
+	if len(backends) == 0 {
+		return fmt.Errorf("no backend found")
+	}
+
+	var err error
+	for _, backend := range backends {
+		err = requestBackend(ctx, do, backend, method, path, contentType, body)
+		if se, ok := err.(*statusError); err == nil || ok && se.code < http.StatusInternalServerError {
+			return err
+		}
+	}
+	return err
+}
+
+func requestBackend(ctx context.Context, do func(req *http.Request) (*http.Response, error), backend, method, path, contentType string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, "https://"+backend+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	resp, err := do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &statusError{code: resp.StatusCode, body: string(bytes.TrimSpace(b))}
+	}
+	return nil
+}
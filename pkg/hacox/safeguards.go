@@ -0,0 +1,127 @@
+package hacox
+
+import (
+	"fmt"
+	"math"
+	"slices"
+)
+
+// Safeguards protect the servers from being shrunk by a single wrong
+// discovery, such as a label mistake or a partial API response.
+type Safeguards struct {
+	// MinServers is the minimum number of discovered apiservers to accept a
+	// discovery, counting the addresses of a node once.
+	MinServers int
+	// MaxRemoveFraction is the maximum fraction of the servers removed by a
+	// discovery, 0 for no limit.
+	MaxRemoveFraction float64
+	// RemoveConfirmations is the number of consecutive discoveries a server
+	// must be missing from before it is removed.
+	RemoveConfirmations int
+	// DryRun logs the changes of a discovery without applying them.
+	DryRun bool
+	// ConsensusServers is the number of servers a discovery queries, keeping
+	// only the addresses reported by a majority of them, 0 to use the first
+	// server that answers.
+	ConsensusServers int
+}
+
+func DefaultSafeguards() Safeguards {
+	return Safeguards{
+		MinServers:          1,
+		MaxRemoveFraction:   0.5,
+		RemoveConfirmations: 2,
+	}
+}
+
+func (s *Safeguards) Validate() error {
+	if s.MinServers < 1 {
+		return fmt.Errorf("the minimum number of servers must be at least 1")
+	}
+	if s.MaxRemoveFraction < 0 || s.MaxRemoveFraction > 1 {
+		return fmt.Errorf("the maximum fraction of removed servers must be between 0 and 1")
+	}
+	if s.RemoveConfirmations < 1 {
+		return fmt.Errorf("the number of removal confirmations must be at least 1")
+	}
+	if s.ConsensusServers < 0 {
+		return fmt.Errorf("the number of consensus servers must not be negative")
+	}
+	return nil
+}
+
+// safeguard returns the entries to apply after a discovery found next on
+// apiservers, and whether they should be applied at all.
+func (sc *ServersConfig) safeguard(next []ServerEntry, apiservers int) ([]ServerEntry, error) {
+	if apiservers < sc.safeguards.MinServers {
+		return nil, fmt.Errorf("discovered %d apiservers, fewer than the minimum %d", apiservers, sc.safeguards.MinServers)
+	}
+
+	contains := func(entries []ServerEntry, address string) bool {
+		return slices.ContainsFunc(entries, func(e ServerEntry) bool { return e.Address == address })
+	}
+
+	var added, removed []string
+	for _, it := range next {
+		delete(sc.missing, it.Address)
+		if !contains(sc.entries, it.Address) {
+			added = append(added, it.Address)
+		}
+	}
+
+	var missing []ServerEntry
+	for _, it := range sc.entries {
+		if !contains(next, it.Address) {
+			sc.missing[it.Address]++
+			missing = append(missing, it)
+		}
+	}
+	for address := range sc.missing {
+		if !contains(sc.entries, address) {
+			delete(sc.missing, address)
+		}
+	}
+
+	// remove the servers missing for the longest time first
+	slices.SortStableFunc(missing, func(a, b ServerEntry) int {
+		return sc.missing[b.Address] - sc.missing[a.Address]
+	})
+
+	limit := len(missing)
+	if sc.safeguards.MaxRemoveFraction > 0 {
+		limit = max(1, int(math.Ceil(float64(len(sc.entries))*sc.safeguards.MaxRemoveFraction)))
+	}
+
+	for _, it := range missing {
+		switch {
+		case it.Source == SourceSeed:
+			// seeds are only used until the first discovery succeeds
+			removed = append(removed, it.Address)
+			continue
+		case sc.missing[it.Address] < sc.safeguards.RemoveConfirmations:
+			sc.log.Info("defer removing server, not confirmed", "address", it.Address, "missing", sc.missing[it.Address], "confirmations", sc.safeguards.RemoveConfirmations)
+		case len(removed) >= limit:
+			sc.log.Info("defer removing server, too many removed", "address", it.Address, "limit", limit)
+		default:
+			removed = append(removed, it.Address)
+			continue
+		}
+		next = append(next, it)
+	}
+	next = normalizeEntries(next)
+
+	if len(added) == 0 && len(removed) == 0 {
+		return next, nil
+	}
+
+	if sc.safeguards.DryRun {
+		sc.log.Info("dry run, servers not changed", "added", added, "removed", removed)
+		return sc.entries, nil
+	}
+
+	sc.log.Info("servers changed", "added", added, "removed", removed)
+	for _, address := range removed {
+		delete(sc.missing, address)
+	}
+	return next, nil
+}
@@ -0,0 +1,151 @@
+package hacox
+
+import (
+	"slices"
+	"testing"
+)
+
+// testEntries returns the entries of the addresses.
+func testEntries(addresses ...string) []ServerEntry {
+	var r []ServerEntry
+	for _, address := range addresses {
+		r = append(r, ServerEntry{Address: address})
+	}
+	return r
+}
+
+func addresses(entries []ServerEntry) []string {
+	var r []string
+	for _, it := range entries {
+		r = append(r, it.Address)
+	}
+	return r
+}
+
+func TestSafeguard(t *testing.T) {
+	tests := []struct {
+		name       string
+		safeguards Safeguards
+		entries    []ServerEntry
+		// discoveries are the addresses found by consecutive discoveries.
+		discoveries [][]string
+		want        []string
+		wantErr     bool
+	}{
+		{
+			name:        "add",
+			safeguards:  DefaultSafeguards(),
+			entries:     testEntries("10.0.0.1"),
+			discoveries: [][]string{{"10.0.0.1", "10.0.0.2"}},
+			want:        []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:        "fewer apiservers than the minimum",
+			safeguards:  Safeguards{MinServers: 2, RemoveConfirmations: 1},
+			entries:     testEntries("10.0.0.1", "10.0.0.2"),
+			discoveries: [][]string{{"10.0.0.1"}},
+			wantErr:     true,
+		},
+		{
+			name:        "removal not confirmed",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 2},
+			entries:     testEntries("10.0.0.1", "10.0.0.2", "10.0.0.3"),
+			discoveries: [][]string{{"10.0.0.1", "10.0.0.2"}},
+			want:        []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+		},
+		{
+			name:        "removal confirmed",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 2},
+			entries:     testEntries("10.0.0.1", "10.0.0.2", "10.0.0.3"),
+			discoveries: [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.1", "10.0.0.2"}},
+			want:        []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:        "confirmations reset when found again",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 2},
+			entries:     testEntries("10.0.0.1", "10.0.0.2"),
+			discoveries: [][]string{{"10.0.0.1"}, {"10.0.0.1", "10.0.0.2"}, {"10.0.0.1"}},
+			want:        []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:        "removal limited by the fraction",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 1, MaxRemoveFraction: 0.5},
+			entries:     testEntries("10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"),
+			discoveries: [][]string{{"10.0.0.1"}},
+			want:        []string{"10.0.0.1", "10.0.0.4"},
+		},
+		{
+			name:        "at least one removal",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 1, MaxRemoveFraction: 0.1},
+			entries:     testEntries("10.0.0.1", "10.0.0.2", "10.0.0.3"),
+			discoveries: [][]string{{"10.0.0.1"}},
+			want:        []string{"10.0.0.1", "10.0.0.3"},
+		},
+		{
+			name:        "no limit",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 1},
+			entries:     testEntries("10.0.0.1", "10.0.0.2", "10.0.0.3"),
+			discoveries: [][]string{{"10.0.0.1"}},
+			want:        []string{"10.0.0.1"},
+		},
+		{
+			name:        "seeds removed at once",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 3, MaxRemoveFraction: 0.1},
+			entries:     []ServerEntry{{Address: "10.0.0.1"}, {Address: "10.0.0.8", Source: SourceSeed}, {Address: "10.0.0.9", Source: SourceSeed}},
+			discoveries: [][]string{{"10.0.0.1"}},
+			want:        []string{"10.0.0.1"},
+		},
+		{
+			name:        "dry run",
+			safeguards:  Safeguards{MinServers: 1, RemoveConfirmations: 1, DryRun: true},
+			entries:     testEntries("10.0.0.1", "10.0.0.2"),
+			discoveries: [][]string{{"10.0.0.1", "10.0.0.3"}},
+			want:        []string{"10.0.0.1", "10.0.0.2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &ServersConfig{
+				entries:    tt.entries,
+				safeguards: tt.safeguards,
+				missing:    make(map[string]int),
+				log:        testLogger(),
+			}
+			var err error
+			for _, discovered := range tt.discoveries {
+				var next []ServerEntry
+				if next, err = sc.safeguard(testEntries(discovered...), len(discovered)); err == nil {
+					sc.entries = next
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !slices.Equal(addresses(sc.entries), tt.want) {
+				t.Errorf("servers = %v, want %v", addresses(sc.entries), tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterHostsAPIServers(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes map[string][]string
+		want  int
+	}{
+		{"one address each", map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}}, 2},
+		{"dual-stack", map[string][]string{"m1": {"10.0.0.1", "fd00::1"}}, 1},
+		{"node and pod addresses", map[string][]string{"m1": {"10.0.0.1", "192.168.0.1"}, "m2": {"10.0.0.2"}}, 2},
+		{"addresses without node", map[string][]string{"": {"10.0.0.1", "10.0.0.2"}, "m3": {"10.0.0.3"}}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := testHosts(tt.nodes).apiservers(); got != tt.want {
+				t.Errorf("apiservers = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
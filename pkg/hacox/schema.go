@@ -0,0 +1,175 @@
+package hacox
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	ServersConfigVersion = 2
+
+	SourceNode = "node"
+	SourcePod  = "pod"
+
+	// lastSeenInterval is how often the last seen time of an entry is
+	// updated, so that the servers config file is not rewritten on every
+	// refresh.
+	lastSeenInterval = time.Hour
+)
+
+// ServerEntry is a backend apiserver in the servers config.
+type ServerEntry struct {
+	Address   string    `yaml:"address"`
+	Port      int       `yaml:"port,omitempty"`
+	Weight    int       `yaml:"weight,omitempty"`
+	Zone      string    `yaml:"zone,omitempty"`
+	NodeName  string    `yaml:"nodeName,omitempty"`
+	Source    string    `yaml:"source,omitempty"`
+	FirstSeen time.Time `yaml:"firstSeen,omitempty"`
+	LastSeen  time.Time `yaml:"lastSeen,omitempty"`
+	// Pinned entries are managed by the operator, discovery never updates
+	// or removes them.
+	Pinned bool `yaml:"pinned,omitempty"`
+}
+
+type serversFile struct {
+	Version int           `yaml:"version"`
+	Servers []ServerEntry `yaml:"servers"`
+}
+
+// backend returns the address with port of the entry, using defaultPort if
+// the entry has no port.
+func (e *ServerEntry) backend(defaultPort int) string {
+	port := e.Port
+	if port == 0 {
+		port = defaultPort
+	}
+	return fmt.Sprintf("%s:%d", wrapIPv6(e.Address), port)
+}
+
+// group returns the apiserver the entry is an address of, its node if known.
+func (e *ServerEntry) group() string {
+	if e.NodeName != "" {
+		return e.NodeName
+	}
+	return e.Address
+}
+
+func (e *ServerEntry) weight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// decodeServers decodes the servers config. Besides the current schema, the
+// version 1 schema, which is a bare list of addresses, is accepted; migrated
+// reports whether the data was in the version 1 schema.
+func decodeServers(r io.Reader) (entries []ServerEntry, migrated bool, err error) {
+	var doc yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, false, err
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, false, fmt.Errorf("empty document")
+	}
+
+	switch doc.Content[0].Kind {
+	case yaml.SequenceNode:
+		var addresses []string
+		if err := doc.Content[0].Decode(&addresses); err != nil {
+			return nil, false, err
+		}
+		for _, it := range addresses {
+			entries = append(entries, ServerEntry{Address: it})
+		}
+		migrated = true
+	case yaml.MappingNode:
+		var f serversFile
+		if err := doc.Content[0].Decode(&f); err != nil {
+			return nil, false, err
+		}
+		if f.Version != ServersConfigVersion {
+			return nil, false, fmt.Errorf("unsupported servers config version %d", f.Version)
+		}
+		entries = f.Servers
+	default:
+		return nil, false, fmt.Errorf("unexpected servers config format")
+	}
+
+	return normalizeEntries(entries), migrated, nil
+}
+
+func encodeServers(entries []ServerEntry) ([]byte, error) {
+	return yaml.Marshal(&serversFile{
+		Version: ServersConfigVersion,
+		Servers: entries,
+	})
+}
+
+// normalizeEntries drops the entries without address, keeps the first entry
+// of each address and sorts the entries by address.
+func normalizeEntries(entries []ServerEntry) []ServerEntry {
+	var r []ServerEntry
+	for _, it := range entries {
+		it.Address = strings.TrimSpace(it.Address)
+		if it.Address == "" {
+			continue
+		}
+		if slices.ContainsFunc(r, func(e ServerEntry) bool { return e.Address == it.Address }) {
+			continue
+		}
+		r = append(r, it)
+	}
+	slices.SortFunc(r, func(a, b ServerEntry) int {
+		return strings.Compare(a.Address, b.Address)
+	})
+	return r
+}
+
+// mergeEntries returns the entries after discovering hosts at now. Pinned
+// entries are kept as they are, the other entries are replaced by the
+// discovered addresses, keeping the port, weight and first seen time of the
+// addresses that were already known, and their last seen time for up to
+// lastSeenInterval.
+func mergeEntries(entries []ServerEntry, hosts *clusterHosts, now time.Time) []ServerEntry {
+	var r []ServerEntry
+	for _, it := range entries {
+		if it.Pinned {
+			r = append(r, it)
+		}
+	}
+
+	for _, address := range hosts.servers() {
+		if slices.ContainsFunc(r, func(e ServerEntry) bool { return e.Address == address }) {
+			continue
+		}
+
+		entry := ServerEntry{
+			Address:   address,
+			FirstSeen: now,
+			LastSeen:  now,
+		}
+		if idx := slices.IndexFunc(entries, func(e ServerEntry) bool { return e.Address == address }); idx != -1 {
+			entry.Port = entries[idx].Port
+			entry.Weight = entries[idx].Weight
+			if !entries[idx].FirstSeen.IsZero() {
+				entry.FirstSeen = entries[idx].FirstSeen
+			}
+			if last := entries[idx].LastSeen; !last.IsZero() && now.Sub(last) < lastSeenInterval {
+				entry.LastSeen = last
+			}
+		}
+		entry.NodeName = hosts.nodeOf(address)
+		entry.Zone = hosts.zones[entry.NodeName]
+		entry.Source = hosts.sources[address]
+		r = append(r, entry)
+	}
+
+	return normalizeEntries(r)
+}
@@ -0,0 +1,140 @@
+package hacox
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeServers(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		want     []ServerEntry
+		migrated bool
+		wantErr  bool
+	}{
+		{
+			name:     "version 1",
+			data:     "- 10.0.0.2\n- 10.0.0.1\n",
+			want:     testEntries("10.0.0.1", "10.0.0.2"),
+			migrated: true,
+		},
+		{
+			name: "version 2",
+			data: "version: 2\nservers:\n- address: 10.0.0.1\n  port: 8443\n  nodeName: m1\n  pinned: true\n",
+			want: []ServerEntry{{Address: "10.0.0.1", Port: 8443, NodeName: "m1", Pinned: true}},
+		},
+		{
+			name: "duplicates and empty addresses dropped",
+			data: "version: 2\nservers:\n- address: 10.0.0.1\n  port: 8443\n- address: ' '\n- address: 10.0.0.1\n",
+			want: []ServerEntry{{Address: "10.0.0.1", Port: 8443}},
+		},
+		{
+			name:    "unsupported version",
+			data:    "version: 3\nservers: []\n",
+			wantErr: true,
+		},
+		{
+			name:    "scalar",
+			data:    "10.0.0.1\n",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			data:    "",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, migrated, err := decodeServers(strings.NewReader(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !reflect.DeepEqual(entries, tt.want) || migrated != tt.migrated {
+				t.Errorf("decodeServers = %+v, %v, want %+v, %v", entries, migrated, tt.want, tt.migrated)
+			}
+		})
+	}
+}
+
+func TestEncodeServersRoundTrip(t *testing.T) {
+	seen := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []ServerEntry{
+		{Address: "10.0.0.1", Port: 8443, Weight: 2, Zone: "a", NodeName: "m1", Source: SourceNode, FirstSeen: seen, LastSeen: seen},
+		{Address: "10.0.0.2", Pinned: true},
+	}
+	data, err := encodeServers(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, migrated, err := decodeServers(strings.NewReader(string(data)))
+	if err != nil || migrated {
+		t.Fatalf("decodeServers = %v, %v", migrated, err)
+	}
+	if !reflect.DeepEqual(decoded, entries) {
+		t.Errorf("decoded %+v, want %+v", decoded, entries)
+	}
+}
+
+func TestMergeEntries(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	first := now.Add(-24 * time.Hour)
+	recent := now.Add(-time.Minute)
+	old := now.Add(-lastSeenInterval)
+
+	hosts := testHosts(map[string][]string{"m1": {"10.0.0.1"}, "m2": {"10.0.0.2"}})
+	hosts.zones["m1"] = "a"
+
+	tests := []struct {
+		name    string
+		entries []ServerEntry
+		want    []ServerEntry
+	}{
+		{
+			name: "new addresses",
+			want: []ServerEntry{
+				{Address: "10.0.0.1", Zone: "a", NodeName: "m1", Source: SourceNode, FirstSeen: now, LastSeen: now},
+				{Address: "10.0.0.2", NodeName: "m2", Source: SourceNode, FirstSeen: now, LastSeen: now},
+			},
+		},
+		{
+			name: "known addresses keep their settings and times",
+			entries: []ServerEntry{
+				{Address: "10.0.0.1", Port: 8443, Weight: 3, FirstSeen: first, LastSeen: recent},
+				{Address: "10.0.0.2", FirstSeen: first, LastSeen: old},
+			},
+			want: []ServerEntry{
+				{Address: "10.0.0.1", Port: 8443, Weight: 3, Zone: "a", NodeName: "m1", Source: SourceNode, FirstSeen: first, LastSeen: recent},
+				{Address: "10.0.0.2", NodeName: "m2", Source: SourceNode, FirstSeen: first, LastSeen: now},
+			},
+		},
+		{
+			name: "missing addresses removed and pinned ones kept",
+			entries: []ServerEntry{
+				{Address: "10.0.0.3", FirstSeen: first},
+				{Address: "10.0.0.9", Port: 8443, Pinned: true},
+				{Address: "10.0.0.1", Port: 9443, Pinned: true},
+			},
+			want: []ServerEntry{
+				{Address: "10.0.0.1", Port: 9443, Pinned: true},
+				{Address: "10.0.0.2", NodeName: "m2", Source: SourceNode, FirstSeen: now, LastSeen: now},
+				{Address: "10.0.0.9", Port: 8443, Pinned: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeEntries(tt.entries, hosts, now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeEntries = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package hacox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	stdnet "net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/utils/net"
+)
+
+const SourceSeed = "seed"
+
+// Seeds are the servers to bootstrap from when the servers config is missing
+// or empty.
+type Seeds struct {
+	Servers []string
+	DNSName string
+}
+
+// bootstrap returns the seed servers from the first source of the seed chain
+// that has any: the server of the kubeconfig cluster, the seed servers and
+// the seed DNS name.
+func (sc *ServersConfig) bootstrap() ([]ServerEntry, error) {
+	for _, it := range []struct {
+		name  string
+		seeds func() ([]ServerEntry, error)
+	}{
+		{"kubeconfig", sc.seedsFromKubeConfig},
+		{"seed servers", sc.seedsFromServers},
+		{"seed dns name", sc.seedsFromDNS},
+	} {
+		entries, err := it.seeds()
+		if err != nil {
+			sc.log.Warn("get seeds error", "source", it.name, "error", err)
+			continue
+		}
+		if len(entries) > 0 {
+			sc.log.Info("bootstrap from seeds", "source", it.name, "seeds", len(entries))
+			return normalizeEntries(entries), nil
+		}
+	}
+
+	return nil, fmt.Errorf("no seed found")
+}
+
+func (sc *ServersConfig) seedsFromKubeConfig() ([]ServerEntry, error) {
+	var errs []error
+	for _, path := range sc.kubeConfigPaths {
+		server, err := kubeConfigServer(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		entries, err := sc.seedsFromHostPort(server)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(entries) > 0 {
+			return entries, nil
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// kubeConfigServer returns the host and port of the server of the current
+// cluster in the kubeconfig file.
+func kubeConfigServer(path string) (string, error) {
+	cfg, err := clientcmd.LoadFromFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	context := cfg.Contexts[cfg.CurrentContext]
+	if context == nil {
+		return "", fmt.Errorf("no context named '%s' found in kubeconfig file %s", cfg.CurrentContext, path)
+	}
+
+	cluster := cfg.Clusters[context.Cluster]
+	if cluster == nil || cluster.Server == "" {
+		return "", fmt.Errorf("no server of cluster '%s' found in kubeconfig file %s", context.Cluster, path)
+	}
+
+	u, err := url.Parse(cluster.Server)
+	if err != nil {
+		return "", fmt.Errorf("parse server %s error: %v", cluster.Server, err)
+	}
+
+	return u.Host, nil
+}
+
+func (sc *ServersConfig) seedsFromServers() ([]ServerEntry, error) {
+	var r []ServerEntry
+	for _, it := range sc.seeds.Servers {
+		entries, err := sc.seedsFromHostPort(it)
+		if err != nil {
+			sc.log.Warn("get seeds error", "source", "seed servers", "server", it, "error", err)
+			continue
+		}
+		r = append(r, entries...)
+	}
+	return r, nil
+}
+
+func (sc *ServersConfig) seedsFromDNS() ([]ServerEntry, error) {
+	if sc.seeds.DNSName == "" {
+		return nil, nil
+	}
+	return sc.seedsFromHostPort(sc.seeds.DNSName)
+}
+
+// seedsFromHostPort resolves the host, with an optional port, to seeds.
+// Loopback addresses are skipped, since they usually point to hacox itself.
+func (sc *ServersConfig) seedsFromHostPort(hostPort string) ([]ServerEntry, error) {
+	host, port := hostPort, 0
+	if h, p, err := stdnet.SplitHostPort(hostPort); err == nil {
+		host = h
+		if port, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid port of %s", hostPort)
+		}
+	}
+	if port == sc.serverPort {
+		port = 0
+	}
+	host = strings.Trim(host, "[]")
+
+	addresses := []string{host}
+	if net.ParseIPSloppy(host) == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		var err error
+		addresses, err = stdnet.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var r []ServerEntry
+	for _, address := range addresses {
+		if ip := net.ParseIPSloppy(address); ip == nil || ip.IsLoopback() {
+			sc.log.Debug("skip seed", "address", address, "server", hostPort)
+			continue
+		}
+		r = append(r, ServerEntry{
+			Address: address,
+			Port:    port,
+			Source:  SourceSeed,
+		})
+	}
+	return r, nil
+}
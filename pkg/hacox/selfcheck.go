@@ -0,0 +1,107 @@
+package hacox
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatInterval is the interval at which the loops of hacox beat while
+// they have nothing else to do.
+const heartbeatInterval = 10 * time.Second
+
+// Heartbeater is implemented by a component that reports when its loop last
+// made progress, such as the built-in discovery. The heartbeats are checked
+// by the liveness check of hacox.
+type Heartbeater interface {
+	LastHeartbeat() time.Time
+}
+
+// heartbeat records when a loop last made progress.
+type heartbeat struct {
+	last atomic.Int64
+}
+
+func (h *heartbeat) beat() {
+	h.last.Store(time.Now().UnixNano())
+}
+
+// Last returns the time of the last beat, or the zero time before the first
+// one.
+func (h *heartbeat) Last() time.Time {
+	if n := h.last.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// CheckLiveness reports whether the proxy, the health check and the
+// discovery loops beat within the liveness timeout. The discovery is only
+// checked if it is a Heartbeater.
+func (h *Hacox) CheckLiveness() error {
+	started := h.started.Last()
+	if started.IsZero() {
+		return fmt.Errorf("hacox is not running")
+	}
+
+	components := []struct {
+		name string
+		Heartbeater
+	}{
+		{"proxy", h.proxy},
+		{"health check", h.hc},
+	}
+	if hb, ok := h.discovery.(Heartbeater); ok {
+		components = append(components, struct {
+			name string
+			Heartbeater
+		}{"discovery", hb})
+	}
+
+	for _, c := range components {
+		last := c.LastHeartbeat()
+		if last.Before(started) {
+			last = started
+		}
+		if time.Since(last) > h.opts.LivenessTimeout {
+			return fmt.Errorf("the %s has not made progress since %s", c.name, last.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// CheckReadiness reports whether the proxy is accepting connections on all
+// of its listeners and the health check found an available backend.
+func (h *Hacox) CheckReadiness() error {
+	if !h.proxy.Serving() {
+		return fmt.Errorf("the proxy is not accepting connections")
+	}
+	return h.checkBackends()
+}
+
+func (h *Hacox) checkBackends() error {
+	if h.hc.LastCheck().IsZero() {
+		return fmt.Errorf("the backends are not checked yet")
+	}
+	for _, backend := range h.registry.List() {
+		if backend.Available() {
+			return nil
+		}
+	}
+	return fmt.Errorf("no available backend")
+}
+
+// checkHandler serves the result of check, 200 with ok or 503 with the error.
+func checkHandler(check func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, err)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+}
@@ -4,21 +4,23 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"slices"
-	"sort"
+	"sync"
 	"time"
 
 	"github.com/thoas/go-funk"
-	yaml "gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/utils/net"
@@ -32,36 +34,86 @@ const (
 
 type UpdateFunc func(servers []string)
 
+// BackendInfo is the metadata of a backend. Backends of the same group are
+// served by the same apiserver.
+type BackendInfo struct {
+	Source string
+	Group  string
+	Weight int
+}
+
+type InfoFunc func(infos map[string]BackendInfo)
+
+// RequestFunc receives the result of a discovery request to a server, with
+// the source the server was discovered from.
+type RequestFunc func(server, source string, err error)
+
+// RefreshFunc receives the number of servers found by a discovery and its
+// error.
+type RefreshFunc func(discovered int, err error)
+
 type ServersConfig struct {
-	client         *http.Client
-	servers        []string
-	configPath     string
-	kubeConfigPath string
-	serverPort     int
-	interval       time.Duration
-	updateFuncs    []UpdateFunc
-	kubeConfig     []byte
-	authHeader     string
-	clientCert     *tls.Certificate
-	disorder       []int
-}
-
-func NewServersConfig(configPath, kubeConfigPath string, serverPort int, interval time.Duration, updateFuncs ...UpdateFunc) (*ServersConfig, error) {
+	client          *http.Client
+	servers         []string
+	entries         []ServerEntry
+	written         []byte
+	configPath      string
+	kubeConfigPaths []string
+	kubeConfigPath  string
+	serverPort      int
+	interval        time.Duration
+	updateFuncs     []UpdateFunc
+	kubeConfig      []byte
+	authHeader      string
+	clientCert      *tls.Certificate
+	clusterCA       *x509.CertPool
+	disorder        []int
+	consensusNext   int
+	filter          DiscoveryFilter
+	policy          *AddressPolicy
+	seeds           Seeds
+	safeguards      Safeguards
+	missing         map[string]int
+	skipped         map[skippedMember]string
+	disagreements   map[string]int
+	hosts           *clusterHosts
+	infos           map[string]BackendInfo
+	infoFuncs       []InfoFunc
+	requestFuncs    []RequestFunc
+	refreshFuncs    []RefreshFunc
+	leases          *leaseMonitor
+	standby         *standbySet
+	registry        *Registry
+	refreshC        chan struct{}
+	heartbeat       heartbeat
+	log             *slog.Logger
+	lock            sync.RWMutex
+}
+
+var errNoServer = errors.New("no server found")
+
+func NewServersConfig(configPath string, kubeConfigPaths []string, serverPort int, interval time.Duration, filter DiscoveryFilter, policy *AddressPolicy, seeds Seeds, safeguards Safeguards, logger *slog.Logger, updateFuncs ...UpdateFunc) (*ServersConfig, error) {
 	if !filepath.IsAbs(configPath) {
 		if pwd, err := os.Getwd(); err == nil {
 			configPath = filepath.Join(pwd, configPath)
 		} else {
-			log.Printf("get current working directory error: %v", err)
-			return nil, err
+			return nil, fmt.Errorf("get current working directory error: %v", err)
 		}
 	}
 
 	sc := &ServersConfig{
-		configPath:     configPath,
-		kubeConfigPath: kubeConfigPath,
-		serverPort:     serverPort,
-		interval:       interval,
-		updateFuncs:    updateFuncs,
+		configPath:      configPath,
+		kubeConfigPaths: kubeConfigPaths,
+		serverPort:      serverPort,
+		interval:        interval,
+		filter:          filter,
+		policy:          policy,
+		seeds:           seeds,
+		safeguards:      safeguards,
+		missing:         make(map[string]int),
+		refreshC:        make(chan struct{}, 1),
+		updateFuncs:     updateFuncs,
+		log:             componentLogger(logger, "discovery"),
 	}
 	sc.client = &http.Client{
 		Timeout: 30 * time.Second,
@@ -73,147 +125,459 @@ func NewServersConfig(configPath, kubeConfigPath string, serverPort int, interva
 		},
 	}
 
-	servers, err := sc.load()
+	entries, migrated, err := sc.load()
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, errNoServer) {
+		sc.log.Info("no server found, bootstrap from seeds", "path", sc.configPath)
+		entries, err = sc.bootstrap()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	sc.updateServers(servers)
+	sc.updateServers(entries)
+	if migrated {
+		sc.log.Info("migrate servers config file", "path", sc.configPath, "version", ServersConfigVersion)
+		_ = sc.save()
+	}
 	return sc, nil
 }
 
+// NotifyInfos registers the infoFuncs to receive the backend metadata
+// whenever it changes.
+func (sc *ServersConfig) NotifyInfos(infoFuncs ...InfoFunc) {
+	sc.infoFuncs = append(sc.infoFuncs, infoFuncs...)
+	for _, f := range infoFuncs {
+		if f != nil {
+			f(maps.Clone(sc.infos))
+		}
+	}
+}
+
+// NotifyRequests registers the requestFuncs to receive the result of every
+// discovery request to a server.
+func (sc *ServersConfig) NotifyRequests(requestFuncs ...RequestFunc) {
+	sc.requestFuncs = append(sc.requestFuncs, requestFuncs...)
+}
+
+// NotifyRefreshes registers the refreshFuncs to receive the result of every
+// discovery.
+func (sc *ServersConfig) NotifyRefreshes(refreshFuncs ...RefreshFunc) {
+	sc.refreshFuncs = append(sc.refreshFuncs, refreshFuncs...)
+}
+
+// Run discovers the backends into the registry until ctx is done.
+func (sc *ServersConfig) Run(ctx context.Context, registry *Registry) error {
+	sc.Register(registry)
+	return sc.Start(ctx)
+}
+
+// Register adds the current backends to the registry and keeps it up to
+// date, so that the backends are known before Run.
+func (sc *ServersConfig) Register(registry *Registry) {
+	if sc.registry == registry {
+		return
+	}
+	sc.registry = registry
+
+	sc.updateFuncs = append(sc.updateFuncs, registry.UpdateBackends)
+	registry.UpdateBackends(sc.serversWithPort())
+	sc.NotifyInfos(registry.UpdateInfos)
+	if sc.leases != nil {
+		sc.leases.staleFuncs = append(sc.leases.staleFuncs, registry.OnStale)
+	}
+	if sc.standby != nil {
+		sc.standby.standbyFuncs = append(sc.standby.standbyFuncs, registry.UpdateStandby)
+	}
+}
+
 func (sc *ServersConfig) Start(ctx context.Context) error {
+	sc.heartbeat.beat()
 	_ = sc.refresh()
 	timer := time.NewTimer(sc.interval)
 	defer timer.Stop()
+
+	var leaseC <-chan time.Time
+	if sc.leases != nil {
+		leaseTicker := time.NewTicker(sc.leases.interval)
+		defer leaseTicker.Stop()
+		leaseC = leaseTicker.C
+	}
+
+	changes, err := watchFile(ctx, sc.configPath, sc.log)
+	if err != nil {
+		sc.log.Error("watch servers config file error", "path", sc.configPath, "error", err)
+	}
+
+	heartbeatTicker := time.NewTicker(heartbeatInterval)
+	defer heartbeatTicker.Stop()
+
 	for {
+		sc.heartbeat.beat()
 		select {
 		case <-timer.C:
-			if err := sc.refresh(); err != nil {
-				log.Printf("refresh servers error: %v", err)
+			sc.refreshNow()
+			timer.Reset(sc.interval)
+		case <-sc.refreshC:
+			sc.refreshNow()
+			if !timer.Stop() {
+				<-timer.C
 			}
 			timer.Reset(sc.interval)
+		case <-leaseC:
+			if err := sc.checkLeases(); err != nil {
+				sc.log.Error("check apiserver leases error", "error", err)
+			}
+		case _, ok := <-changes:
+			if !ok {
+				changes = nil
+				continue
+			}
+			sc.reload()
+		case <-heartbeatTicker.C:
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
 
+// LastHeartbeat returns when the loop of the discovery last made progress,
+// which it does after each request to a server.
+func (sc *ServersConfig) LastHeartbeat() time.Time {
+	return sc.heartbeat.Last()
+}
+
+// Refresh requests a discovery without waiting for the refresh interval.
+func (sc *ServersConfig) Refresh() {
+	select {
+	case sc.refreshC <- struct{}{}:
+	default:
+	}
+}
+
+func (sc *ServersConfig) refreshNow() {
+	if err := sc.refresh(); err != nil {
+		sc.log.Error("refresh servers error", "error", err)
+	}
+	sc.updateStandby(nil, sc.serversWithPort())
+}
+
 func (sc *ServersConfig) refresh() error {
-	servers, err := sc.fromCluster()
+	discovered, err := sc.discover()
+	for _, f := range sc.refreshFuncs {
+		if f != nil {
+			f(discovered, err)
+		}
+	}
+	return err
+}
+
+// discover updates the servers from the cluster and returns the number of
+// servers found.
+func (sc *ServersConfig) discover() (int, error) {
+	hosts, err := sc.fromCluster()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if slices.Equal(sc.servers, servers) {
-		return nil
+	sc.logSkipped(hosts)
+	discovered := len(hosts.servers())
+	if discovered == 0 {
+		return 0, errNoServer
+	}
+	entries, err := sc.safeguard(mergeEntries(sc.entries, hosts, time.Now().Truncate(time.Second)), hosts.apiservers())
+	if err != nil {
+		return discovered, err
 	}
-	if len(servers) == 0 {
-		return fmt.Errorf("no server found")
+	if sc.safeguards.DryRun {
+		return discovered, nil
 	}
-	sc.updateServers(servers)
-	return sc.save()
+	sc.updateServers(entries)
+	return discovered, sc.save()
 }
 
-func (sc *ServersConfig) updateServers(servers []string) {
-	if len(servers) != len(sc.servers) {
-		sc.disorder = disorder(len(servers))
+func (sc *ServersConfig) updateServers(entries []ServerEntry) {
+	if len(entries) != len(sc.entries) {
+		sc.disorder = disorder(len(entries))
 	}
-	sc.servers = servers
+
+	oldBackends := sc.serversWithPort()
+	sc.entries = entries
+	sc.servers = funk.Map(entries, func(entry ServerEntry) string {
+		return entry.Address
+	}).([]string)
 	serversWithPort := sc.serversWithPort()
-	for _, f := range sc.updateFuncs {
-		if f != nil {
-			f(serversWithPort)
+
+	if !slices.Equal(oldBackends, serversWithPort) {
+		for _, f := range sc.updateFuncs {
+			if f != nil {
+				f(serversWithPort)
+			}
+		}
+	}
+	sc.updateStandby(oldBackends, serversWithPort)
+
+	infos := make(map[string]BackendInfo)
+	for _, entry := range entries {
+		infos[entry.backend(sc.serverPort)] = BackendInfo{
+			Source: entry.Source,
+			Group:  entry.group(),
+			Weight: entry.weight(),
+		}
+	}
+	if !maps.Equal(sc.infos, infos) {
+		sc.infos = infos
+		for _, f := range sc.infoFuncs {
+			if f != nil {
+				f(maps.Clone(infos))
+			}
 		}
 	}
 }
 
 func (sc *ServersConfig) serversWithPort() []string {
-	return funk.Map(sc.servers, func(server string) string {
-		return fmt.Sprintf("%s:%d", wrapIPv6(server), sc.serverPort)
+	return funk.Map(sc.entries, func(entry ServerEntry) string {
+		return entry.backend(sc.serverPort)
 	}).([]string)
 }
 
-func (sc *ServersConfig) load() ([]string, error) {
-	f, err := os.Open(sc.configPath)
+// backendOf returns the backend of the entry with the given address.
+func (sc *ServersConfig) backendOf(address string) (string, bool) {
+	idx := slices.IndexFunc(sc.entries, func(e ServerEntry) bool { return e.Address == address })
+	if idx == -1 {
+		return "", false
+	}
+	return sc.entries[idx].backend(sc.serverPort), true
+}
+
+// load loads the servers config, falling back to the backup of the last
+// good servers config if it is missing or invalid.
+func (sc *ServersConfig) load() ([]ServerEntry, bool, error) {
+	r, migrated, err := sc.loadFile(sc.configPath)
+	if err == nil {
+		return r, migrated, nil
+	}
+
+	backupPath := sc.configPath + backupSuffix
+	if _, statErr := os.Stat(backupPath); statErr != nil {
+		return nil, false, err
+	}
+
+	sc.log.Warn("load servers config from backup", "path", backupPath)
+	r, migrated, backupErr := sc.loadFile(backupPath)
+	if backupErr != nil {
+		return nil, false, err
+	}
+	return r, migrated, nil
+}
+
+func (sc *ServersConfig) loadFile(path string) ([]ServerEntry, bool, error) {
+	data, err := readServersFile(path)
 	if err != nil {
-		log.Printf("open %s error: %v", sc.configPath, err)
-		return nil, err
+		sc.log.Error("read servers config file error", "path", path, "error", err)
+		return nil, false, err
 	}
-	defer f.Close()
 
-	var r []string
-	if err := yaml.NewDecoder(f).Decode(&r); err != nil {
-		log.Printf("decode %s error: %v", sc.configPath, err)
-		return nil, err
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, false, fmt.Errorf("%w in %s", errNoServer, path)
+	}
+
+	r, migrated, err := decodeServers(bytes.NewReader(data))
+	if err != nil {
+		sc.log.Error("decode servers config file error", "path", path, "error", err)
+		return nil, false, err
 	}
 
 	if len(r) == 0 {
-		return nil, fmt.Errorf("no server found in %s", sc.configPath)
+		return nil, false, fmt.Errorf("%w in %s", errNoServer, path)
+	}
+
+	if path == sc.configPath {
+		sc.written = data
+	}
+	return r, migrated, nil
+}
+
+// reload applies the manual changes of the servers config file. Invalid
+// changes are rejected and the current servers are kept.
+func (sc *ServersConfig) reload() {
+	data, err := readServersFile(sc.configPath)
+	if err != nil {
+		sc.log.Error("read servers config file error", "path", sc.configPath, "error", err)
+		return
+	}
+	if bytes.Equal(data, sc.written) {
+		return
+	}
+
+	entries, _, err := decodeServers(bytes.NewReader(data))
+	if err == nil && len(entries) == 0 {
+		err = errNoServer
+	}
+	if err != nil {
+		sc.log.Warn("reject changes of servers config file", "path", sc.configPath, "error", err)
+		return
 	}
 
-	r = funk.UniqString(r)
-	sort.Strings(r)
-	return r, nil
+	sc.log.Info("apply changes of servers config file", "path", sc.configPath)
+	sc.written = data
+	sc.updateServers(entries)
 }
 
-func (sc *ServersConfig) fromCluster() ([]string, error) {
+func (sc *ServersConfig) fromCluster() (*clusterHosts, error) {
 	var err error
 	if err := sc.prepareAuthConfig(); err != nil {
-		log.Printf("prepare auth config error: %v", err)
+		sc.log.Error("prepare auth config error", "error", err)
 		return nil, err
 	}
 
+	if sc.safeguards.ConsensusServers > 0 {
+		hosts, err := sc.fromClusterConsensus()
+		if err != nil {
+			return nil, err
+		}
+		sc.hosts = hosts
+		return hosts, nil
+	}
+
 	for _, idx := range sc.disorder {
 		server := sc.servers[idx]
-		var servers []string
-		servers, err = sc.fetchFromCluster(server, sc.serverPort)
+		var hosts *clusterHosts
+		hosts, err = sc.fetchFromServer(idx)
 		if err != nil {
-			log.Printf("get servers from cluster with server %s error: %v", server, err)
+			sc.log.Warn("get servers from cluster error", "server", server, "error", err)
 			continue
 		}
-		return servers, nil
+		sc.hosts = hosts
+		return hosts, nil
 	}
 	return nil, err
 }
 
+// portOf returns the port of the idx-th server.
+func (sc *ServersConfig) portOf(idx int) int {
+	if port := sc.entries[idx].Port; port != 0 {
+		return port
+	}
+	return sc.serverPort
+}
+
 func (sc *ServersConfig) save() error {
-	encoded, err := yaml.Marshal(sc.servers)
+	encoded, err := encodeServers(sc.entries)
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(sc.configPath, encoded, os.FileMode(0644)); err != nil {
-		log.Printf("write servers config file %s error: %v", sc.configPath, err)
+	if bytes.Equal(encoded, sc.written) {
+		return nil
+	}
+	if err := writeServersFile(sc.configPath, encoded, sc.log); err != nil {
+		sc.log.Error("write servers config file error", "path", sc.configPath, "error", err)
 		return err
 	}
+	sc.written = encoded
 	return nil
 }
 
 func (sc *ServersConfig) getClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
 	return sc.clientCert, nil
 }
 
+// setAuth sets the credentials and the cluster CA prepared from kubeConfig,
+// which may be used by the requests of other components while the discovery
+// prepares them.
+func (sc *ServersConfig) setAuth(authHeader string, clientCert *tls.Certificate, clusterCA *x509.CertPool, kubeConfig []byte) {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	sc.authHeader = authHeader
+	sc.clientCert = clientCert
+	sc.clusterCA = clusterCA
+	sc.kubeConfig = kubeConfig
+}
+
+// prepareAuthConfig prepares the credentials from the first kubeconfig file
+// that exists and has valid credentials, so that a kubeconfig file earlier in
+// the list is switched to as soon as it becomes usable.
 func (sc *ServersConfig) prepareAuthConfig() error {
-	kubeConfig, err := os.ReadFile(sc.kubeConfigPath)
+	var errs []error
+	for _, path := range sc.kubeConfigPaths {
+		if err := sc.prepareAuthConfigFrom(path); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if path != sc.kubeConfigPath {
+			if sc.kubeConfigPath == "" {
+				sc.log.Info("use kubeconfig file", "path", path)
+			} else {
+				sc.log.Warn("switch kubeconfig file", "from", sc.kubeConfigPath, "path", path)
+			}
+			sc.lock.Lock()
+			sc.kubeConfigPath = path
+			sc.lock.Unlock()
+		}
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// ClusterCA returns the CA of the cluster in the kubeconfig file in use, nil
+// if it has none.
+func (sc *ServersConfig) ClusterCA() *x509.CertPool {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
+	return sc.clusterCA
+}
+
+// ActiveKubeConfig returns the path of the kubeconfig file in use, or an
+// empty string if none is usable yet.
+func (sc *ServersConfig) ActiveKubeConfig() string {
+	sc.lock.RLock()
+	defer sc.lock.RUnlock()
+
+	return sc.kubeConfigPath
+}
+
+func checkCertificateExpiry(cert *tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return fmt.Errorf("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		return fmt.Errorf("read kubeconfig file %s error: %v", sc.kubeConfigPath, err)
+		return err
 	}
-	if bytes.Equal(kubeConfig, sc.kubeConfig) {
-		return nil
+	if now := time.Now(); now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (sc *ServersConfig) prepareAuthConfigFrom(path string) error {
+	kubeConfig, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read kubeconfig file %s error: %v", path, err)
+	}
+	if path == sc.kubeConfigPath && bytes.Equal(kubeConfig, sc.kubeConfig) {
+		if sc.clientCert == nil || checkCertificateExpiry(sc.clientCert) == nil {
+			return nil
+		}
+		// the client certificate expired, load it again in case its files
+		// were renewed
 	}
 
 	cfg, err := clientcmd.Load(kubeConfig)
 	if err != nil {
-		log.Printf("load kubeconfig file %s error: %v", sc.kubeConfigPath, err)
-		return err
+		return fmt.Errorf("load kubeconfig file %s error: %v", path, err)
 	}
 
 	if len(cfg.Contexts) == 0 {
-		return fmt.Errorf("no context found in kubeconfig file %s", sc.kubeConfigPath)
+		return fmt.Errorf("no context found in kubeconfig file %s", path)
 	}
 
 	context := cfg.Contexts[cfg.CurrentContext]
 	if context == nil {
-		return fmt.Errorf("no context named '%s' found in kubeconfig file %s", cfg.CurrentContext, sc.kubeConfigPath)
+		return fmt.Errorf("no context named '%s' found in kubeconfig file %s", cfg.CurrentContext, path)
 	}
 
 	authInfo := cfg.AuthInfos[context.AuthInfo]
@@ -221,10 +585,23 @@ func (sc *ServersConfig) prepareAuthConfig() error {
 		return fmt.Errorf("no auth info named '%s' found in context %s", context.AuthInfo, cfg.CurrentContext)
 	}
 
+	// the CA is only used to diagnose the serving certificates of the
+	// backends, hacox does not verify them
+	var clusterCA *x509.CertPool
+	if cluster := cfg.Clusters[context.Cluster]; cluster != nil {
+		caData := cluster.CertificateAuthorityData
+		if len(caData) == 0 && cluster.CertificateAuthority != "" {
+			if caData, err = os.ReadFile(cluster.CertificateAuthority); err != nil {
+				sc.log.Warn("read cluster CA error", "path", cluster.CertificateAuthority, "error", err)
+			}
+		}
+		if pool := x509.NewCertPool(); len(caData) > 0 && pool.AppendCertsFromPEM(caData) {
+			clusterCA = pool
+		}
+	}
+
 	if authInfo.Token != "" {
-		sc.authHeader = "Bearer " + authInfo.Token
-		sc.clientCert = nil
-		sc.kubeConfig = kubeConfig
+		sc.setAuth("Bearer "+authInfo.Token, nil, clusterCA, kubeConfig)
 		return nil
 	}
 
@@ -233,16 +610,12 @@ func (sc *ServersConfig) prepareAuthConfig() error {
 		if err != nil {
 			return fmt.Errorf("read token file %s error: %v", authInfo.TokenFile, err)
 		}
-		sc.authHeader = "Bearer " + string(token)
-		sc.clientCert = nil
-		sc.kubeConfig = kubeConfig
+		sc.setAuth("Bearer "+string(token), nil, clusterCA, kubeConfig)
 		return nil
 	}
 
 	if authInfo.Username != "" && authInfo.Password != "" {
-		sc.authHeader = "Basic " + base64.StdEncoding.EncodeToString([]byte(authInfo.Username+":"+authInfo.Password))
-		sc.clientCert = nil
-		sc.kubeConfig = kubeConfig
+		sc.setAuth("Basic "+base64.StdEncoding.EncodeToString([]byte(authInfo.Username+":"+authInfo.Password)), nil, clusterCA, kubeConfig)
 		return nil
 	}
 
@@ -251,9 +624,10 @@ func (sc *ServersConfig) prepareAuthConfig() error {
 		if err != nil {
 			return fmt.Errorf("parse client certificate error: %v", err)
 		}
-		sc.clientCert = &cert
-		sc.authHeader = ""
-		sc.kubeConfig = kubeConfig
+		if err := checkCertificateExpiry(&cert); err != nil {
+			return fmt.Errorf("client certificate in kubeconfig file %s: %v", path, err)
+		}
+		sc.setAuth("", &cert, clusterCA, kubeConfig)
 		return nil
 	}
 
@@ -262,9 +636,10 @@ func (sc *ServersConfig) prepareAuthConfig() error {
 		if err != nil {
 			return fmt.Errorf("load client certificate from file %s and key file %s error: %v", authInfo.ClientCertificate, authInfo.ClientKey, err)
 		}
-		sc.clientCert = &cert
-		sc.authHeader = ""
-		sc.kubeConfig = kubeConfig
+		if err := checkCertificateExpiry(&cert); err != nil {
+			return fmt.Errorf("client certificate file %s: %v", authInfo.ClientCertificate, err)
+		}
+		sc.setAuth("", &cert, clusterCA, kubeConfig)
 		return nil
 	}
 
@@ -276,15 +651,24 @@ func (sc *ServersConfig) prepareAuthConfig() error {
 		return fmt.Errorf("auth provider is not supported")
 	}
 
-	sc.clientCert = nil
-	sc.authHeader = ""
-	sc.kubeConfig = kubeConfig
+	sc.setAuth("", nil, clusterCA, kubeConfig)
 	return nil
 }
 
+type ObjectMeta struct {
+	Name              string            `json:"name"`
+	Labels            map[string]string `json:"labels"`
+	DeletionTimestamp *time.Time        `json:"deletionTimestamp,omitempty"`
+}
+
 type Node struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		Unschedulable bool `json:"unschedulable"`
+	} `json:"spec"`
 	Status struct {
-		Addresses []corev1.NodeAddress `json:"addresses"`
+		Addresses  []corev1.NodeAddress   `json:"addresses"`
+		Conditions []corev1.NodeCondition `json:"conditions"`
 	} `json:"status"`
 }
 
@@ -293,9 +677,15 @@ type NodeList struct {
 }
 
 type Pod struct {
+	Metadata ObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
 	Status struct {
-		PodIP   string          `json:"podIP"`
-		HostIPs []corev1.HostIP `json:"hostIPs"`
+		Phase      corev1.PodPhase       `json:"phase"`
+		Conditions []corev1.PodCondition `json:"conditions"`
+		PodIP      string                `json:"podIP"`
+		HostIPs    []corev1.HostIP       `json:"hostIPs"`
 	} `json:"status"`
 }
 
@@ -309,15 +699,39 @@ func (sc *ServersConfig) request(url string) (*http.Response, error) {
 		return nil, err
 	}
 	req.Header.Set("Accept", "application/json")
-	if sc.authHeader != "" {
-		req.Header.Set("Authorization", sc.authHeader)
-	}
+	resp, err := sc.Do(req)
+	// a refresh trying many unreachable servers is still making progress
+	sc.heartbeat.beat()
+	return resp, err
+}
+
+// Do sends req to the cluster with the credentials of the kubeconfig file in
+// use, without verifying the serving certificate like the discovery.
+func (sc *ServersConfig) Do(req *http.Request) (*http.Response, error) {
+	sc.lock.RLock()
+	authHeader := sc.authHeader
+	sc.lock.RUnlock()
 
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
 	return sc.client.Do(req)
 }
 
-func (sc *ServersConfig) fetchFromCluster(server string, serverPort int) ([]string, error) {
-	var r []string
+// fetchFromServer gets the servers from the cluster with the idx-th server.
+func (sc *ServersConfig) fetchFromServer(idx int) (*clusterHosts, error) {
+	entry := sc.entries[idx]
+	hosts, err := sc.fetchFromCluster(entry.Address, sc.portOf(idx))
+	for _, f := range sc.requestFuncs {
+		if f != nil {
+			f(entry.backend(sc.serverPort), entry.Source, err)
+		}
+	}
+	return hosts, err
+}
+
+func (sc *ServersConfig) fetchFromCluster(server string, serverPort int) (*clusterHosts, error) {
+	hosts := newClusterHosts()
 
 	endpoint := fmt.Sprintf("https://%s:%d", wrapIPv6(server), serverPort)
 
@@ -328,36 +742,28 @@ func (sc *ServersConfig) fetchFromCluster(server string, serverPort int) ([]stri
 		url := fmt.Sprintf("%s/api/v1/nodes?labelSelector=%s", endpoint, label)
 		resp, err := sc.request(url)
 		if err != nil {
-			log.Printf("get nodes from %s error: %v", url, err)
-			return nil, err
+			return nil, fmt.Errorf("get nodes from %s error: %v", url, err)
 		}
 		defer resp.Body.Close()
 
-		t, err := fromNodes(resp.Body)
-		if err != nil {
-			log.Printf("decode nodes from %s error: %v", url, err)
-			return nil, err
+		if err := fromNodes(resp.Body, hosts, &sc.filter, sc.policy, sc.log); err != nil {
+			return nil, fmt.Errorf("decode nodes from %s error: %v", url, err)
 		}
-		r = merge(r, t)
 	}
 
 	url := fmt.Sprintf("%s/api/v1/namespaces/kube-system/pods?labelSelector=%s", endpoint, labelPodComponentKubeApiserver)
 	resp, err := sc.request(url)
 	if err != nil {
-		log.Printf("get pods from %s error: %v", url, err)
-		return nil, err
+		return nil, fmt.Errorf("get pods from %s error: %v", url, err)
 	}
 	defer resp.Body.Close()
 
-	t, err := fromPods(resp.Body)
-	if err != nil {
-		log.Printf("decode pods from %s error: %v", url, err)
-		return nil, err
+	if err := fromPods(resp.Body, hosts, &sc.filter, sc.policy, sc.log); err != nil {
+		return nil, fmt.Errorf("decode pods from %s error: %v", url, err)
 	}
-	r = merge(r, t)
+	sc.policy.preferFamily(hosts, sc.log)
 
-	sort.Strings(r)
-	return r, nil
+	return hosts, nil
 }
 
 func merge(a, b []string) []string {
@@ -390,35 +796,87 @@ func wrapIPv6(server string) string {
 	return server
 }
 
-func fromNodes(data io.ReadCloser) ([]string, error) {
+// logSkipped logs the nodes and pods skipped by the discovery whenever they
+// change, rather than on every refresh.
+func (sc *ServersConfig) logSkipped(hosts *clusterHosts) {
+	for m, reason := range hosts.skipped {
+		if sc.skipped[m] != reason {
+			sc.log.Info("skip "+m.kind, m.kind, m.name, "reason", reason)
+		}
+	}
+	for m := range sc.skipped {
+		if _, ok := hosts.skipped[m]; !ok {
+			sc.log.Info(m.kind+" no longer skipped", m.kind, m.name)
+		}
+	}
+	sc.skipped = hosts.skipped
+}
+
+// fromNodes adds the selected addresses of the nodes to hosts.
+func fromNodes(data io.ReadCloser, hosts *clusterHosts, filter *DiscoveryFilter, policy *AddressPolicy, log *slog.Logger) error {
 	var nodeList NodeList
 	if err := json.NewDecoder(data).Decode(&nodeList); err != nil {
-		return nil, err
+		return err
 	}
 
-	var r []string
 	for _, node := range nodeList.Items {
+		if reason := filter.nodeSkipReason(&node); reason != "" {
+			hosts.skipped[skippedMember{"node", node.Metadata.Name}] = reason
+			continue
+		}
+
 		for _, it := range node.Status.Addresses {
-			if it.Type == corev1.NodeInternalIP {
-				r = append(r, it.Address)
+			switch it.Type {
+			case corev1.NodeInternalIP, corev1.NodeExternalIP:
+				if reason := policy.skipReason(string(it.Type), it.Address); reason != "" {
+					log.Debug("skip address", "address", it.Address, "node", node.Metadata.Name, "reason", reason)
+					continue
+				}
+				hosts.add(node.Metadata.Name, it.Address, SourceNode)
+			case corev1.NodeHostName:
+				hosts.alias(it.Address, node.Metadata.Name)
 			}
 		}
+		if zone := node.Metadata.Labels[corev1.LabelTopologyZone]; zone != "" {
+			hosts.zones[node.Metadata.Name] = zone
+		}
 	}
-	return r, nil
+	return nil
 }
 
-func fromPods(data io.ReadCloser) ([]string, error) {
+// fromPods adds the selected addresses of the pods to hosts, grouped by the
+// node they are running on. The pods on the nodes skipped by fromNodes are
+// skipped too.
+func fromPods(data io.ReadCloser, hosts *clusterHosts, filter *DiscoveryFilter, policy *AddressPolicy, log *slog.Logger) error {
 	var podList PodList
 	if err := json.NewDecoder(data).Decode(&podList); err != nil {
-		return nil, err
+		return err
 	}
 
-	var r []string
 	for _, pod := range podList.Items {
-		r = append(r, pod.Status.PodIP)
+		reason := filter.podSkipReason(&pod)
+		if nodeReason, ok := hosts.skipped[skippedMember{"node", pod.Spec.NodeName}]; ok && reason == "" {
+			reason = nodeReason
+		}
+		if reason != "" {
+			hosts.skipped[skippedMember{"pod", pod.Metadata.Name}] = reason
+			continue
+		}
+
+		add := func(addressType, address string) {
+			if reason := policy.skipReason(addressType, address); reason != "" {
+				log.Debug("skip address", "address", address, "pod", pod.Metadata.Name, "reason", reason)
+				return
+			}
+			hosts.add(pod.Spec.NodeName, address, SourcePod)
+		}
+
+		if pod.Status.PodIP != "" {
+			add(AddressTypePodIP, pod.Status.PodIP)
+		}
 		for _, ip := range pod.Status.HostIPs {
-			r = append(r, ip.IP)
+			add(AddressTypeHostIP, ip.IP)
 		}
 	}
-	return r, nil
+	return nil
 }
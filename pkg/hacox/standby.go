@@ -0,0 +1,74 @@
+package hacox
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+type StandbyFunc func(backends []string)
+
+type standbySet struct {
+	ttl          time.Duration
+	standbyFuncs []StandbyFunc
+	expires      map[string]time.Time
+}
+
+// KeepStandby enables keeping the removed servers as standby backends for
+// ttl. The standbyFuncs receive the standby backends whenever they change.
+func (sc *ServersConfig) KeepStandby(ttl time.Duration, standbyFuncs ...StandbyFunc) {
+	if ttl <= 0 {
+		return
+	}
+
+	sc.standby = &standbySet{
+		ttl:          ttl,
+		standbyFuncs: standbyFuncs,
+		expires:      make(map[string]time.Time),
+	}
+}
+
+// updateStandby moves the removed backends to standby, drops the standby
+// backends that are active again or expired, and notifies the changes.
+func (sc *ServersConfig) updateStandby(oldBackends, backends []string) {
+	if sc.standby == nil {
+		return
+	}
+
+	changed := false
+	now := time.Now()
+	for _, it := range oldBackends {
+		if !slices.Contains(backends, it) {
+			sc.log.Info("keep removed server as standby", "backend", it, "ttl", sc.standby.ttl)
+			sc.standby.expires[it] = now.Add(sc.standby.ttl)
+			changed = true
+		}
+	}
+	for it, expires := range sc.standby.expires {
+		switch {
+		case slices.Contains(backends, it):
+			sc.log.Info("standby server is active again", "backend", it)
+		case now.After(expires):
+			sc.log.Info("standby server expired", "backend", it)
+		default:
+			continue
+		}
+		delete(sc.standby.expires, it)
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	standby := make([]string, 0, len(sc.standby.expires))
+	for it := range sc.standby.expires {
+		standby = append(standby, it)
+	}
+	sort.Strings(standby)
+	for _, f := range sc.standby.standbyFuncs {
+		if f != nil {
+			f(slices.Clone(standby))
+		}
+	}
+}
@@ -2,68 +2,35 @@ package hacox
 
 import (
 	"context"
-	"log"
-	"strings"
 	"time"
 )
 
-func Start(kubeConfigPath, serversConfigPath, metricsAddr string, listenAddrs []string, backendPort, unHealthyCountThreshold int, checkInterval, refreshInterval time.Duration) error {
-
-	log.Printf("starting hacox on %s", strings.Join(listenAddrs, ", "))
-	log.Printf("unhealthy count threshold: %d", unHealthyCountThreshold)
-	log.Printf("refresh interval: %s", refreshInterval)
-	log.Printf("check interval: %s", checkInterval)
-	log.Printf("kubeconfig path: %s", kubeConfigPath)
-	log.Printf("servers config path: %s", serversConfigPath)
-	log.Printf("backend port: %d", backendPort)
-	log.Printf("metrics addr: %s", metricsAddr)
-
-	proxy := NewProxy(listenAddrs)
-	hc := NewHealthCheck(checkInterval, unHealthyCountThreshold, proxy.OnNotify)
-	metrics := NewMetrics(metricsAddr, proxy.GetBackendsClientsCount, hc.GetBackendsHealth)
-
-	sc, err := NewServersConfig(serversConfigPath, kubeConfigPath, backendPort, refreshInterval, proxy.UpdateBackends, hc.UpdateBackends)
+// Start runs hacox with the built-in discovery until a component fails.
+//
+// Deprecated: Use New and Hacox.Run, which take Options and stop with a
+// context.
+func Start(kubeConfigPaths []string, serversConfigPath, metricsAddr string, listenAddrs []string, backendPort, unHealthyCountThreshold int, checkInterval, refreshInterval, leaseCheckInterval, leaseStaleThreshold, standbyTTL, standbyCheckInterval time.Duration, filter DiscoveryFilter, policy *AddressPolicy, seeds Seeds, safeguards Safeguards) error {
+	opts := DefaultOptions()
+	opts.KubeConfigPaths = kubeConfigPaths
+	opts.ServersConfigPath = serversConfigPath
+	opts.MetricsAddr = metricsAddr
+	opts.ListenAddrs = listenAddrs
+	opts.BackendPort = backendPort
+	opts.UnHealthyCountThreshold = unHealthyCountThreshold
+	opts.CheckInterval = checkInterval
+	opts.RefreshInterval = refreshInterval
+	opts.LeaseCheckInterval = leaseCheckInterval
+	opts.LeaseStaleThreshold = leaseStaleThreshold
+	opts.StandbyTTL = standbyTTL
+	opts.StandbyCheckInterval = standbyCheckInterval
+	opts.Filter = filter
+	opts.AddressPolicy = policy
+	opts.Seeds = seeds
+	opts.Safeguards = safeguards
+
+	h, err := New(opts)
 	if err != nil {
 		return err
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go func() {
-		err = metrics.Start(ctx)
-		if err != nil {
-			log.Printf("start metrics server error: %v", err)
-		}
-		cancel()
-	}()
-
-	go func() {
-		err = hc.Start(ctx)
-		if err != nil {
-			log.Printf("start health check error: %v", err)
-		}
-		cancel()
-	}()
-
-	go func() {
-		err = sc.Start(ctx)
-		if err != nil {
-			log.Printf("start servers config error: %v", err)
-		}
-		cancel()
-	}()
-
-	go func() {
-		err = proxy.Start(ctx)
-		if err != nil {
-			log.Printf("start proxy error: %v", err)
-		}
-		cancel()
-	}()
-
-	log.Println("hacox started")
-	<-ctx.Done()
-	log.Println("hacox stopped")
-	return err
+	return h.Run(context.Background())
 }
@@ -0,0 +1,69 @@
+package hacox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+var errStopped = errors.New("stopped unexpectedly")
+
+// ComponentError is the failure of a component of hacox.
+type ComponentError struct {
+	Component string
+	Err       error
+}
+
+func (e *ComponentError) Error() string {
+	return fmt.Sprintf("%s failed: %v", e.Component, e.Err)
+}
+
+func (e *ComponentError) Unwrap() error {
+	return e.Err
+}
+
+// supervisor runs the components and stops all of them when one of them
+// fails, keeping the error of the first failed component.
+type supervisor struct {
+	stop func()
+	wg   sync.WaitGroup
+	once sync.Once
+	err  error
+	log  *slog.Logger
+}
+
+func newSupervisor(stop func(), log *slog.Logger) *supervisor {
+	return &supervisor{stop: stop, log: log}
+}
+
+// Go runs the component with ctx. The component fails if it returns an error,
+// or returns before ctx is done.
+func (s *supervisor) Go(ctx context.Context, name string, run func(ctx context.Context) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		err := run(ctx)
+		if err == nil && ctx.Err() == nil {
+			err = errStopped
+		}
+		if err == nil {
+			return
+		}
+
+		s.once.Do(func() {
+			s.err = &ComponentError{Component: name, Err: err}
+			s.log.Error("component stopped", "component", name, "error", err)
+			s.stop()
+		})
+	}()
+}
+
+// Wait waits for all the components to return, and returns the error of the
+// first failed component.
+func (s *supervisor) Wait() error {
+	s.wg.Wait()
+	return s.err
+}
@@ -0,0 +1,187 @@
+package hacox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const listenFdsStart = 3
+
+// SystemdListeners returns the listeners passed by systemd socket activation
+// through LISTEN_FDS, or nothing if hacox is not socket activated. Since it is
+// called before New, it logs with the default logger of slog.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// the variables must not be passed on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("fd %d", listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, it := range listeners {
+				it.Close()
+			}
+			return nil, fmt.Errorf("use systemd socket %s error: %v", name, err)
+		}
+		slog.Info("use systemd socket", "component", "systemd", "name", name, "listener", listener.Addr().String())
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// sdNotify sends the state to systemd through NOTIFY_SOCKET, and does
+// nothing if hacox is not run by systemd.
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	if addr[0] == '@' {
+		// abstract socket
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns the watchdog interval of systemd from
+// WATCHDOG_USEC, or 0 if the watchdog is disabled.
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// systemdNotifier reports the readiness, the backend health and the
+// liveness of hacox to systemd.
+type systemdNotifier struct {
+	registry *Registry
+	hc       *HealthCheck
+	proxy    *Proxy
+	// checkReady is the readiness check of hacox.
+	checkReady func() error
+	ready      bool
+	status     string
+	log        *slog.Logger
+}
+
+// Run sends READY=1 once hacox is ready, see Hacox.CheckReadiness,
+// STATUS= whenever the health of the backends changes, and WATCHDOG=1 at
+// half the watchdog interval as long as the loops of the proxy and the health
+// check make progress, including while the proxy waits to bind or drains.
+func (n *systemdNotifier) Run(ctx context.Context) error {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var watchdogC <-chan time.Time
+	watchdog := watchdogInterval()
+	if watchdog > 0 {
+		n.log.Info("systemd watchdog enabled", "interval", watchdog)
+		watchdogTicker := time.NewTicker(watchdog / 2)
+		defer watchdogTicker.Stop()
+		watchdogC = watchdogTicker.C
+	}
+
+	for {
+		select {
+		case <-ticker.C:
+			n.notifyStatus()
+		case <-watchdogC:
+			if last := n.proxy.LastHeartbeat(); time.Since(last) > watchdog {
+				n.log.Warn("skip systemd watchdog, the proxy is stuck", "lastHeartbeat", last.Format(time.RFC3339))
+				continue
+			}
+			if last := n.hc.LastHeartbeat(); !last.IsZero() && time.Since(last) > watchdog {
+				n.log.Warn("skip systemd watchdog, the health check is stuck", "lastHeartbeat", last.Format(time.RFC3339))
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				n.log.Error("notify systemd watchdog error", "error", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (n *systemdNotifier) notifyStatus() {
+	var healthy, unhealthy, standby []string
+	for _, backend := range n.registry.List() {
+		switch {
+		case backend.Standby:
+			standby = append(standby, backend.Address)
+		case backend.Healthy:
+			healthy = append(healthy, backend.Address)
+		default:
+			unhealthy = append(unhealthy, backend.Address)
+		}
+	}
+
+	status := fmt.Sprintf("%d/%d backends healthy", len(healthy), len(healthy)+len(unhealthy))
+	if len(unhealthy) > 0 {
+		status += ", unhealthy: " + strings.Join(unhealthy, " ")
+	}
+	if len(standby) > 0 {
+		status += fmt.Sprintf(", %d standby", len(standby))
+	}
+
+	var states []string
+	if status != n.status {
+		states = append(states, "STATUS="+status)
+	}
+	if !n.ready && n.checkReady() == nil {
+		states = append(states, "READY=1")
+	}
+	if len(states) == 0 {
+		return
+	}
+
+	if err := sdNotify(strings.Join(states, "\n")); err != nil {
+		n.log.Error("notify systemd error", "error", err)
+		return
+	}
+	n.status = status
+	if slices.Contains(states, "READY=1") {
+		n.ready = true
+	}
+}